@@ -0,0 +1,12 @@
+// Command straw2 runs straw2 scale scenarios, see package straw2/sim.
+package main
+
+import (
+	"os"
+
+	"straw2/sim"
+)
+
+func main() {
+	os.Exit(sim.Main(os.Args[1:]))
+}
@@ -0,0 +1,17 @@
+package straw2
+
+import "errors"
+
+// Errors returned by the topology and migration operations. They are
+// wrapped with the ids involved, test them with errors.Is.
+var (
+	ErrMgNotFound   = errors.New("mg not found")
+	ErrMgExists     = errors.New("mg already exists")
+	ErrPeNotFound   = errors.New("pe not found")
+	ErrPeExists     = errors.New("pe already exists")
+	ErrKeyDuplicate = errors.New("key already placed")
+	ErrKeyNotFound  = errors.New("key not found")
+	ErrNoMg         = errors.New("no weighted mg")
+	ErrNoPe         = errors.New("no weighted pe")
+	ErrInconsistent = errors.New("inconsistent device")
+)
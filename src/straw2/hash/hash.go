@@ -0,0 +1,89 @@
+// Package hash holds the hash functions of straw2 selection.
+package hash
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+const crush_hash_seed uint32 = uint32(1315423911)
+
+func crush_hashmix(a, b, c uint32) (uint32, uint32, uint32) {
+	a = a - b
+	a = a - c
+	a = a ^ (c >> 13)
+	b = b - c
+	b = b - a
+	b = b ^ (a << 8)
+	c = c - a
+	c = c - b
+	c = c ^ (b >> 13)
+	a = a - b
+	a = a - c
+	a = a ^ (c >> 12)
+	b = b - c
+	b = b - a
+	b = b ^ (a << 16)
+	c = c - a
+	c = c - b
+	c = c ^ (b >> 5)
+	a = a - b
+	a = a - c
+	a = a ^ (c >> 3)
+	b = b - c
+	b = b - a
+	b = b ^ (a << 10)
+	c = c - a
+	c = c - b
+	c = c ^ (b >> 15)
+	return a, b, c
+}
+
+// Rjenkins2 is crush_hash32_rjenkins1_2 of Ceph, the hash straw2 draws
+// MGs with.
+func Rjenkins2(a, b uint32) uint32 {
+	hash := crush_hash_seed ^ a ^ b
+	x := uint32(231232)
+	y := uint32(1232)
+	a, b, hash = crush_hashmix(a, b, hash)
+	x, a, hash = crush_hashmix(x, a, hash)
+	b, y, hash = crush_hashmix(b, y, hash)
+	return hash
+}
+
+// Rjenkins3 is crush_hash32_rjenkins1_3 of Ceph, the hash straw2 draws
+// PEs with.
+func Rjenkins3(a, b, c uint32) uint32 {
+	hash := crush_hash_seed ^ a ^ b ^ c
+	x := uint32(231232)
+	y := uint32(1232)
+	a, b, hash = crush_hashmix(a, b, hash)
+	c, x, hash = crush_hashmix(c, x, hash)
+	y, a, hash = crush_hashmix(y, a, hash)
+	b, x, hash = crush_hashmix(b, x, hash)
+	y, c, hash = crush_hashmix(y, c, hash)
+	return hash
+}
+
+// Hash, Hash2 and Hash3 are CRC32 hashes of their big endian arguments.
+func Hash(x uint32) uint32 {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(x))
+	return crc32.ChecksumIEEE(data)
+}
+
+func Hash2(x, mg_id uint32) uint32 {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, uint32(x))
+	binary.BigEndian.PutUint32(data[4:], uint32(mg_id))
+	return crc32.ChecksumIEEE(data)
+}
+
+func Hash3(x, mg_id, pe_id uint32) uint32 {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data, uint32(x))
+	binary.BigEndian.PutUint32(data[4:], uint32(mg_id))
+	binary.BigEndian.PutUint32(data[8:], uint32(pe_id))
+
+	return crc32.ChecksumIEEE(data)
+}
@@ -0,0 +1,162 @@
+package straw2
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Snapshot is one published version of the topology of a Placement. It
+// holds copies of the MG and PE buckets and is never modified, so any
+// number of goroutines may use it.
+type Snapshot struct {
+	version   uint64
+	mg_bucket Bucket
+	mgs       map[uint32]*Bucket
+}
+
+func newSnapshot(device *Device, version uint64) *Snapshot {
+	snapshot := &Snapshot{version: version, mgs: make(map[uint32]*Bucket, len(device.Mgs))}
+	device.MgBucket.Clone(&snapshot.mg_bucket)
+	for _, mg := range device.Mgs {
+		pe_bucket := &Bucket{}
+		mg.PeBucket.Clone(pe_bucket)
+		snapshot.mgs[mg.Id] = pe_bucket
+	}
+	return snapshot
+}
+
+// Version counts the topology changes published before this snapshot,
+// starting at 1.
+func (self *Snapshot) Version() uint64 {
+	return self.version
+}
+
+// Select returns the MG and the PE key is placed on in this version.
+func (self *Snapshot) Select(key uint32) (mg_id, pe_id uint32, err error) {
+	if self.mg_bucket.Weight == 0 {
+		return 0, 0, ErrNoMg
+	}
+	mg_id = self.mg_bucket.Select(key)
+	pe_bucket, ok := self.mgs[mg_id]
+	if !ok {
+		return 0, 0, fmt.Errorf("mg %d: %w", mg_id, ErrMgNotFound)
+	}
+	if pe_bucket.Weight == 0 {
+		return 0, 0, fmt.Errorf("mg %d: %w", mg_id, ErrNoPe)
+	}
+	return mg_id, pe_bucket.Select2(mg_id, key), nil
+}
+
+// Placement answers Select from many goroutines while the topology
+// changes. Every change is made on a copy and published as a new Snapshot
+// with one atomic store, so a reader sees either the old version or the
+// new one, never a half-updated bucket. Changes are serialized by a mutex
+// and do not block readers.
+//
+// A Placement holds no keys, only the MGs and PEs with their weights.
+type Placement struct {
+	mutex   sync.Mutex
+	device  *Device
+	current atomic.Pointer[Snapshot]
+}
+
+// NewPlacement returns a placement with the topology of device. The keys
+// of device are not copied.
+func NewPlacement(device *Device) *Placement {
+	topology := topologyOf(device)
+	placement := &Placement{device: topology}
+	placement.current.Store(newSnapshot(topology, 1))
+	return placement
+}
+
+// topologyOf returns a copy of the MGs and PEs of device without keys.
+func topologyOf(device *Device) *Device {
+	topology := &Device{Id: device.Id}
+	for _, v := range device.Mgs {
+		mg := &MG{Id: v.Id, Labels: v.Labels}
+		for _, pe := range v.Pes {
+			mg.AddPe(pe.Id, pe.Weight)
+			mg.Pes[len(mg.Pes)-1].Labels = pe.Labels
+		}
+		topology.AddMg(mg)
+	}
+	return topology
+}
+
+// Snapshot returns the current version. Use it to look up several keys in
+// the same version.
+func (self *Placement) Snapshot() *Snapshot {
+	return self.current.Load()
+}
+
+// Select returns the MG and the PE key is placed on in the current version.
+func (self *Placement) Select(key uint32) (mg_id, pe_id uint32, err error) {
+	return self.current.Load().Select(key)
+}
+
+// Device returns a copy of the current topology.
+func (self *Placement) Device() *Device {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.device.Clone()
+}
+
+// Update applies change to the current topology and publishes the device
+// it returns. change must not modify the device it gets, the Scale methods
+// of Device are safe to use. On error nothing is published.
+func (self *Placement) Update(change func(device *Device) (*Device, error)) (uint64, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	device, err := change(self.device)
+	if err != nil {
+		return self.current.Load().version, err
+	}
+
+	version := self.current.Load().version + 1
+	self.device = device
+	self.current.Store(newSnapshot(device, version))
+	return version, nil
+}
+
+// Publish replaces the topology with the one of device, for a caller that
+// changes its own device and keeps the placement in step.
+func (self *Placement) Publish(device *Device) uint64 {
+	version, _ := self.Update(func(*Device) (*Device, error) {
+		return topologyOf(device), nil
+	})
+	return version
+}
+
+func (self *Placement) ScaleOutMg(mg_id, pe_num, pe_weight uint32) (uint64, error) {
+	return self.Update(func(device *Device) (*Device, error) {
+		return device.ScaleOutMg(mg_id, pe_num, pe_weight)
+	})
+}
+
+func (self *Placement) ScaleInMg(mg_id uint32) (uint64, error) {
+	return self.Update(func(device *Device) (*Device, error) {
+		return device.ScaleInMg(mg_id)
+	})
+}
+
+func (self *Placement) ScaleUpMg(mg_id, pe_id, pe_weight uint32) (uint64, error) {
+	return self.Update(func(device *Device) (*Device, error) {
+		return device.ScaleUpMg(mg_id, pe_id, pe_weight)
+	})
+}
+
+func (self *Placement) ScaleDownMg(mg_id, pe_id uint32) (uint64, error) {
+	return self.Update(func(device *Device) (*Device, error) {
+		return device.ScaleDownMg(mg_id, pe_id)
+	})
+}
+
+// Reweight changes the weight of PE pe_id of MG mg_id, and with it the
+// weight of the MG.
+func (self *Placement) Reweight(mg_id, pe_id, weight uint32) (uint64, error) {
+	return self.Update(func(device *Device) (*Device, error) {
+		return device.ReweightPe(mg_id, pe_id, weight)
+	})
+}
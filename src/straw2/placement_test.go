@@ -0,0 +1,216 @@
+package straw2
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func benchmarkDevice() *Device {
+	return NewDevice(10, 20, 4)
+}
+
+const testKeys = 4096
+
+type placed struct {
+	mg_id uint32
+	pe_id uint32
+}
+
+// placements returns where select puts the keys 0 to testKeys-1.
+func placements(t *testing.T, select_ func(key uint32) (uint32, uint32, error)) []placed {
+	result := make([]placed, testKeys)
+	for key := uint32(0); key < testKeys; key++ {
+		mg_id, pe_id, err := select_(key)
+		if err != nil {
+			t.Fatalf("key %d: %v", key, err)
+		}
+		result[key] = placed{mg_id, pe_id}
+	}
+	return result
+}
+
+func comparePlacements(t *testing.T, name string, got, want []placed) {
+	t.Helper()
+	for key := range want {
+		if got[key] != want[key] {
+			t.Fatalf("%s: key %d on MG[%d] PE[%d], want MG[%d] PE[%d]", name, key,
+				got[key].mg_id, got[key].pe_id, want[key].mg_id, want[key].pe_id)
+		}
+	}
+}
+
+func TestPlacementSelect(t *testing.T) {
+	device := benchmarkDevice()
+	placement := NewPlacement(device)
+	comparePlacements(t, "new", placements(t, placement.Snapshot().Select), placements(t, device.Select))
+
+	device, err := device.ScaleOutMg(100, 20, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := placement.Publish(device); version != 2 {
+		t.Fatalf("published version %d, want 2", version)
+	}
+	comparePlacements(t, "publish", placements(t, placement.Snapshot().Select), placements(t, device.Select))
+
+	if _, err := placement.ScaleUpMg(100, 21, 8); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := placement.Reweight(1, device.Mgs[0].Pes[0].Id, 1); err != nil {
+		t.Fatal(err)
+	}
+	device = placement.Device()
+	comparePlacements(t, "update", placements(t, placement.Snapshot().Select), placements(t, device.Select))
+	comparePlacements(t, "placement", placements(t, placement.Select), placements(t, device.Select))
+}
+
+// TestPlacementSwap checks that every snapshot a reader gets selects like
+// one of the published devices, never like a mix of two, while a writer
+// publishes them. Run it with -race.
+func TestPlacementSwap(t *testing.T) {
+	const versions = 50
+
+	devices := []*Device{benchmarkDevice()}
+	for i := 1; i < versions; i++ {
+		device := devices[i-1]
+		mg := device.Mgs[i%len(device.Mgs)]
+		var err error
+		if i%5 == 0 {
+			device, err = device.ScaleOutMg(uint32(100+i), 20, 4)
+		} else {
+			device, err = device.ReweightPe(mg.Id, mg.Pes[i%len(mg.Pes)].Id, uint32(1+i%8))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		devices = append(devices, device)
+	}
+	// expected[v] is where version v places the keys, version 1 being the
+	// first device.
+	expected := make([][]placed, versions+1)
+	for i, v := range devices {
+		expected[i+1] = placements(t, v.Select)
+	}
+
+	placement := NewPlacement(devices[0])
+	done := make(chan struct{})
+	wait := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				snapshot := placement.Snapshot()
+				for key := uint32(0); key < testKeys; key++ {
+					mg_id, pe_id, err := snapshot.Select(key)
+					if err != nil {
+						t.Errorf("version %d key %d: %v", snapshot.Version(), key, err)
+						return
+					}
+					if want := expected[snapshot.Version()][key]; (placed{mg_id, pe_id}) != want {
+						t.Errorf("version %d: key %d on MG[%d] PE[%d], want MG[%d] PE[%d]",
+							snapshot.Version(), key, mg_id, pe_id, want.mg_id, want.pe_id)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	for i, v := range devices[1:] {
+		if version := placement.Publish(v); version != uint64(i+2) {
+			t.Errorf("published version %d, want %d", version, i+2)
+		}
+	}
+	close(done)
+	wait.Wait()
+}
+
+func BenchmarkDeviceSelect(b *testing.B) {
+	device := benchmarkDevice()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		device.Select(uint32(i))
+	}
+}
+
+func BenchmarkPlacementSelect(b *testing.B) {
+	placement := NewPlacement(benchmarkDevice())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		placement.Select(uint32(i))
+	}
+}
+
+func BenchmarkPlacementSelectParallel(b *testing.B) {
+	placement := NewPlacement(benchmarkDevice())
+	key := uint32(0)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		x := atomic.AddUint32(&key, 1<<20)
+		for pb.Next() {
+			placement.Select(x)
+			x++
+		}
+	})
+}
+
+// BenchmarkPlacementSelectParallelSwap reads from every goroutine while
+// one writer keeps adding and removing an MG.
+func BenchmarkPlacementSelectParallelSwap(b *testing.B) {
+	placement := NewPlacement(benchmarkDevice())
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	swaps := 0
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			placement.ScaleOutMg(100, 20, 4)
+			placement.ScaleInMg(100)
+			swaps += 2
+		}
+	}()
+
+	key := uint32(0)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		x := atomic.AddUint32(&key, 1<<20)
+		for pb.Next() {
+			if _, _, err := placement.Select(x); err != nil {
+				b.Error(err)
+				return
+			}
+			x++
+		}
+	})
+	b.StopTimer()
+
+	close(stop)
+	<-done
+	b.ReportMetric(float64(swaps), "swaps")
+}
+
+func BenchmarkPlacementSnapshotSelectParallel(b *testing.B) {
+	placement := NewPlacement(benchmarkDevice())
+	key := uint32(0)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		snapshot := placement.Snapshot()
+		x := atomic.AddUint32(&key, 1<<20)
+		for pb.Next() {
+			snapshot.Select(x)
+			x++
+		}
+	})
+}
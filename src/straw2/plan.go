@@ -0,0 +1,75 @@
+package straw2
+
+import (
+	"sort"
+)
+
+// Move is one key moved by Migrate.
+type Move struct {
+	Key      uint32
+	FromMgId uint32
+	FromPeId uint32
+	ToMgId   uint32
+	ToPeId   uint32
+}
+
+type peKey struct {
+	mg_id uint32
+	pe_id uint32
+}
+
+// SortMoves orders moves by key, which makes plans of the same change
+// identical from run to run.
+func SortMoves(moves []Move) {
+	sort.Slice(moves, func(i, j int) bool {
+		return moves[i].Key < moves[j].Key
+	})
+}
+
+// PlanBatches groups moves into batches that can run one after another, in
+// each of which no PE takes part in more than limit moves, counting the
+// keys it sends and receives. Moves keep their order within a batch, and
+// every move goes to the first batch with room on both of its PEs. A limit
+// of 0 puts all moves in one batch.
+func PlanBatches(moves []Move, limit uint32) [][]Move {
+	if len(moves) == 0 {
+		return [][]Move{}
+	}
+	if limit == 0 {
+		return [][]Move{moves}
+	}
+
+	batches := make([][]Move, 0)
+	counts := make([]map[peKey]uint32, 0)
+	// first holds, per PE, the first batch that may still have room for
+	// it: batches before it are full for that PE.
+	first := make(map[peKey]int)
+	for _, move := range moves {
+		from := peKey{move.FromMgId, move.FromPeId}
+		to := peKey{move.ToMgId, move.ToPeId}
+
+		index := first[from]
+		if first[to] > index {
+			index = first[to]
+		}
+		for ; index < len(batches); index++ {
+			if counts[index][from] < limit && counts[index][to] < limit {
+				break
+			}
+		}
+		if index == len(batches) {
+			batches = append(batches, make([]Move, 0))
+			counts = append(counts, make(map[peKey]uint32))
+		}
+
+		batches[index] = append(batches[index], move)
+		counts[index][from]++
+		counts[index][to]++
+		for _, pe := range []peKey{from, to} {
+			for first[pe] < len(batches) && counts[first[pe]][pe] >= limit {
+				first[pe]++
+			}
+		}
+	}
+	return batches
+}
@@ -0,0 +1,88 @@
+package straw2
+
+import (
+	"testing"
+)
+
+// planTestMoves returns n moves between the PEs of mgs MGs of pes PEs, each
+// from one PE to the next one.
+func planTestMoves(n, mgs, pes uint32) []Move {
+	moves := make([]Move, 0, n)
+	for i := uint32(0); i < n; i++ {
+		from := i % (mgs * pes)
+		to := (i*7 + 1) % (mgs * pes)
+		if to == from {
+			to = (to + 1) % (mgs * pes)
+		}
+		moves = append(moves, Move{Key: i, FromMgId: from / pes, FromPeId: from % pes, ToMgId: to / pes, ToPeId: to % pes})
+	}
+	return moves
+}
+
+func TestPlanBatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		moves   []Move
+		limit   uint32
+		batches int // -1 for any number
+	}{
+		{"empty", []Move{}, 4, 0},
+		{"no limit", planTestMoves(100, 2, 4), 0, 1},
+		{"one pe", []Move{{Key: 1, ToPeId: 1}, {Key: 2, ToPeId: 2}, {Key: 3, ToPeId: 3}}, 1, 3},
+		{"limit 1", planTestMoves(64, 2, 4), 1, -1},
+		{"limit 4", planTestMoves(1000, 4, 8), 4, -1},
+		{"limit above moves", planTestMoves(10, 2, 4), 100, 1},
+	}
+
+	for _, test := range tests {
+		batches := PlanBatches(test.moves, test.limit)
+		if test.batches >= 0 && len(batches) != test.batches {
+			t.Errorf("%s: %d batches, want %d", test.name, len(batches), test.batches)
+		}
+
+		seen := make(map[uint32]bool)
+		total := 0
+		for i, batch := range batches {
+			if len(batch) == 0 {
+				t.Errorf("%s: batch %d is empty", test.name, i)
+			}
+			counts := make(map[peKey]uint32)
+			last := -1
+			for _, move := range batch {
+				counts[peKey{move.FromMgId, move.FromPeId}]++
+				counts[peKey{move.ToMgId, move.ToPeId}]++
+				if seen[move.Key] {
+					t.Errorf("%s: key %d is in two batches", test.name, move.Key)
+				}
+				seen[move.Key] = true
+				if int(move.Key) < last {
+					t.Errorf("%s: batch %d does not keep the order of the moves", test.name, i)
+				}
+				last = int(move.Key)
+			}
+			for pe, n := range counts {
+				if test.limit > 0 && n > test.limit {
+					t.Errorf("%s: MG[%d] PE[%d] takes part in %d moves of batch %d, limit %d", test.name, pe.mg_id, pe.pe_id, n, i, test.limit)
+				}
+			}
+			total += len(batch)
+		}
+		if total != len(test.moves) {
+			t.Errorf("%s: %d moves in batches, want %d", test.name, total, len(test.moves))
+		}
+	}
+}
+
+// TestPlanBatchesFirst checks that a move goes to the first batch with room
+// on both of its PEs, not just after the batch of the move before it.
+func TestPlanBatchesFirst(t *testing.T) {
+	moves := []Move{
+		{Key: 1, FromPeId: 1, ToPeId: 2},
+		{Key: 2, FromPeId: 1, ToPeId: 3},
+		{Key: 3, FromPeId: 4, ToPeId: 5},
+	}
+	batches := PlanBatches(moves, 1)
+	if len(batches) != 2 || len(batches[0]) != 2 || batches[0][1].Key != 3 || batches[1][0].Key != 2 {
+		t.Fatalf("batches %v, want [[1 3] [2]]", batches)
+	}
+}
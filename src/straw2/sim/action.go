@@ -0,0 +1,547 @@
+package sim
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"straw2"
+)
+
+type ActionScaleOut struct {
+	mg_id     uint32
+	pe_num    uint32
+	pe_weight uint32
+}
+
+func (self *ActionScaleOut) Run(sbc *straw2.Device) (*straw2.Device, error) {
+	if sbc == nil {
+		return nil, ErrNoDevice
+	}
+	return sbc.ScaleOutMg(self.mg_id, self.pe_num, self.pe_weight)
+}
+
+func (self *ActionScaleOut) Params() map[string]uint32 {
+	return map[string]uint32{
+		"mg_id":     self.mg_id,
+		"pe_num":    self.pe_num,
+		"pe_weight": self.pe_weight,
+	}
+}
+
+func (self *ActionScaleOut) Name() string {
+	return "scale_out"
+}
+
+func (self *ActionScaleOut) Enter() string {
+	str := fmt.Sprintf("---------------------------------------------------------------------\n")
+	str += fmt.Sprintf(Msg("enter_scale_out"), self.mg_id, self.pe_num, self.pe_weight)
+	str += fmt.Sprintf("---------------------------------------------------------------------\n")
+	return str
+}
+
+type ActionScaleIn struct {
+	mg_id uint32
+}
+
+func (self *ActionScaleIn) Run(sbc *straw2.Device) (*straw2.Device, error) {
+	if sbc == nil {
+		return nil, ErrNoDevice
+	}
+	return sbc.ScaleInMg(self.mg_id)
+}
+
+func (self *ActionScaleIn) Params() map[string]uint32 {
+	return map[string]uint32{
+		"mg_id": self.mg_id,
+	}
+}
+
+func (self *ActionScaleIn) Name() string {
+	return "scale_in"
+}
+
+func (self *ActionScaleIn) Enter() string {
+	str := fmt.Sprintf("---------------------------------------------------------------------\n")
+	str += fmt.Sprintf(Msg("enter_scale_in"), self.mg_id)
+	str += fmt.Sprintf("---------------------------------------------------------------------\n")
+	return str
+}
+
+type ActionScaleUp struct {
+	mg_id     uint32
+	pe_id     uint32
+	pe_weight uint32
+}
+
+func (self *ActionScaleUp) Run(sbc *straw2.Device) (*straw2.Device, error) {
+	if sbc == nil {
+		return nil, ErrNoDevice
+	}
+	return sbc.ScaleUpMg(self.mg_id, self.pe_id, self.pe_weight)
+}
+
+func (self *ActionScaleUp) Params() map[string]uint32 {
+	return map[string]uint32{
+		"mg_id":     self.mg_id,
+		"pe_id":     self.pe_id,
+		"pe_weight": self.pe_weight,
+	}
+}
+
+func (self *ActionScaleUp) Name() string {
+	return "scale_up"
+}
+
+func (self *ActionScaleUp) Enter() string {
+	str := fmt.Sprintf("---------------------------------------------------------------------\n")
+	str += fmt.Sprintf(Msg("enter_scale_up"), self.mg_id, self.pe_id, self.pe_weight)
+	str += fmt.Sprintf("---------------------------------------------------------------------\n")
+	return str
+}
+
+type ActionScaleDown struct {
+	mg_id uint32
+	pe_id uint32
+}
+
+func (self *ActionScaleDown) Run(sbc *straw2.Device) (*straw2.Device, error) {
+	if sbc == nil {
+		return nil, ErrNoDevice
+	}
+	return sbc.ScaleDownMg(self.mg_id, self.pe_id)
+}
+
+func (self *ActionScaleDown) Params() map[string]uint32 {
+	return map[string]uint32{
+		"mg_id": self.mg_id,
+		"pe_id": self.pe_id,
+	}
+}
+
+func (self *ActionScaleDown) Name() string {
+	return "scale_down"
+}
+
+func (self *ActionScaleDown) Enter() string {
+	str := fmt.Sprintf("---------------------------------------------------------------------\n")
+	str += fmt.Sprintf(Msg("enter_scale_down"), self.mg_id, self.pe_id)
+	str += fmt.Sprintf("---------------------------------------------------------------------\n")
+	return str
+}
+
+type ActionReweight struct {
+	mg_id  uint32
+	pe_id  uint32
+	weight uint32
+}
+
+func (self *ActionReweight) Run(sbc *straw2.Device) (*straw2.Device, error) {
+	if sbc == nil {
+		return nil, ErrNoDevice
+	}
+	return sbc.ReweightPe(self.mg_id, self.pe_id, self.weight)
+}
+
+func (self *ActionReweight) Params() map[string]uint32 {
+	return map[string]uint32{
+		"mg_id":  self.mg_id,
+		"pe_id":  self.pe_id,
+		"weight": self.weight,
+	}
+}
+
+func (self *ActionReweight) Name() string {
+	return "reweight"
+}
+
+func (self *ActionReweight) Enter() string {
+	str := fmt.Sprintf("---------------------------------------------------------------------\n")
+	str += fmt.Sprintf(Msg("enter_reweight"), self.mg_id, self.pe_id, self.weight)
+	str += fmt.Sprintf("---------------------------------------------------------------------\n")
+	return str
+}
+
+// ErrNoDevice is returned by the actions that need a device when there is
+// none yet, or by restore when the checkpoint holds none.
+var ErrNoDevice = errors.New("no device")
+
+// Action is one step of a scenario. Run returns the device after the
+// step and must not modify sbc. On error the device is left as it was.
+type Action interface {
+	Run(sbc *straw2.Device) (*straw2.Device, error)
+	Name() string
+	Params() map[string]uint32
+	Enter() string
+}
+
+type ActionPowerOn struct {
+	rands_num uint32
+	mg_num    uint32
+	pe_num    uint32
+	pe_weight uint32
+	topology  *Topology
+}
+
+func NewActionPowerOn(args *ActionArgs) (Action, error) {
+	action := &ActionPowerOn{rands_num: args.values["rands_num"], pe_weight: args.values["pe_weight"]}
+	if topology, ok := args.topologies["topology"]; ok {
+		if args.Has("mg_num") || args.Has("pe_num") {
+			return nil, fmt.Errorf("power_on takes either topology or mg_num and pe_num")
+		}
+		action.topology = topology
+		return action, nil
+	}
+
+	if !args.Has("mg_num") || !args.Has("pe_num") {
+		return nil, fmt.Errorf("power_on needs mg_num and pe_num, or a topology")
+	}
+	action.mg_num = args.values["mg_num"]
+	action.pe_num = args.values["pe_num"]
+	return action, nil
+}
+
+func (self *ActionPowerOn) Run(sbc *straw2.Device) (*straw2.Device, error) {
+	rands := straw2.NewRands(self.rands_num)
+	if self.topology != nil {
+		sbc = self.topology.NewDevice()
+	} else {
+		sbc = straw2.NewDevice(self.mg_num, self.pe_num, self.pe_weight)
+	}
+
+	for key, _ := range rands {
+		mg_id, pe_id, err := sbc.Select(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := sbc.AddDataById(mg_id, pe_id, key); err != nil {
+			return nil, err
+		}
+	}
+
+	return sbc, nil
+}
+
+func (self *ActionPowerOn) Params() map[string]uint32 {
+	if self.topology != nil {
+		return map[string]uint32{
+			"rands_num": self.rands_num,
+		}
+	}
+
+	return map[string]uint32{
+		"rands_num": self.rands_num,
+		"mg_num":    self.mg_num,
+		"pe_num":    self.pe_num,
+		"pe_weight": self.pe_weight,
+	}
+}
+
+func (self *ActionPowerOn) Args() *ActionArgs {
+	args := NewActionArgs(self.Params())
+	if self.topology != nil {
+		args.topologies["topology"] = self.topology
+	}
+	return args
+}
+
+func (self *ActionPowerOn) Name() string {
+	return "power_on"
+}
+
+func (self *ActionPowerOn) Enter() string {
+	str := fmt.Sprintf("---------------------------------------------------------------------\n")
+	if self.topology != nil {
+		mg_num, pe_num := self.topology.Size()
+		str += fmt.Sprintf(Msg("enter_power_on_topology"), self.rands_num, mg_num, pe_num)
+	} else {
+		str += fmt.Sprintf(Msg("enter_power_on"), self.rands_num, self.mg_num, self.pe_num, self.pe_weight)
+	}
+	str += fmt.Sprintf("---------------------------------------------------------------------\n")
+	return str
+}
+
+// RunPolicy tells ActionList.Run what to do when an action fails.
+type RunPolicy int
+
+const (
+	// PolicyStop ends the run at the failed action.
+	PolicyStop RunPolicy = iota
+	// PolicyContinue runs the next action on the device as it was before
+	// the failed one.
+	PolicyContinue
+)
+
+var policyNames = []string{"stop", "continue"}
+
+func (self RunPolicy) String() string {
+	if int(self) < len(policyNames) {
+		return policyNames[self]
+	}
+	return fmt.Sprintf("policy(%d)", int(self))
+}
+
+func ParsePolicy(name string) (RunPolicy, bool) {
+	for i, v := range policyNames {
+		if v == name {
+			return RunPolicy(i), true
+		}
+	}
+	return PolicyStop, false
+}
+
+// ActionError is an error returned by an action of a run. Index counts
+// from 1 within the action list, or within the alternative of Branch.
+type ActionError struct {
+	Index  int
+	Action string
+	Branch string
+	Err    error
+}
+
+func (self *ActionError) Error() string {
+	if len(self.Branch) > 0 {
+		return fmt.Sprintf("action %d %s in alt %s: %v", self.Index, self.Action, self.Branch, self.Err)
+	}
+	return fmt.Sprintf("action %d %s: %v", self.Index, self.Action, self.Err)
+}
+
+func (self *ActionError) Unwrap() error {
+	return self.Err
+}
+
+// ActionList is a parsed scenario. Run fills in the reports, errors and
+// failures.
+type ActionList struct {
+	actions     []Action
+	policy      RunPolicy
+	verify      bool
+	dryRun      bool
+	reports     []*ActionReport
+	branches    []*BranchReport
+	errors      []*ActionError
+	failures    []string
+	checkpoints map[string]*straw2.Device
+	model       *MigrationModel
+	traced      map[uint32][]*KeyStep
+	// last is the result of the action before, previewed or not, whose
+	// moves export_plan writes, and previous its report, which expect
+	// checks. They are nil when the current device is not the result of
+	// an action: at the start of a run or an alternative, and after a
+	// failure, a restore or a branch.
+	last     *straw2.Device
+	previous *ActionReport
+	// warnings are those of parsing, Run renders them first.
+	warnings []string
+}
+
+func NewActionList() *ActionList {
+	return &ActionList{actions: make([]Action, 0)}
+}
+
+// SetPolicy sets what Run does when an action fails. The default is
+// PolicyStop.
+func (self *ActionList) SetPolicy(policy RunPolicy) {
+	self.policy = policy
+}
+
+// SetVerify makes Run verify the device after every action that changes
+// it, as if a verify action followed.
+func (self *ActionList) SetVerify(verify bool) {
+	self.verify = verify
+}
+
+// SetDryRun makes Run preview every action that starts from a device: its
+// report shows the moves and the balance after it, but the next action
+// starts from the device before it.
+func (self *ActionList) SetDryRun(dryRun bool) {
+	self.dryRun = dryRun
+}
+
+// Errors returns the errors of the actions that failed in the last Run.
+func (self *ActionList) Errors() []*ActionError {
+	return self.errors
+}
+
+// Run runs the actions in order, writes their output to renderer and
+// returns the last device. A failed action is recorded in Errors and ends
+// the run or not according to the policy.
+func (self *ActionList) Run(renderer *Renderer) *straw2.Device {
+	self.checkpoints = nil
+	self.model = nil
+	return self.RunFrom(renderer, nil)
+}
+
+// RunFrom is Run starting with device sbc instead of no device. The
+// checkpoints of an earlier RunFrom can still be restored, and its
+// migration model still times the moves.
+func (self *ActionList) RunFrom(renderer *Renderer, sbc *straw2.Device) *straw2.Device {
+	self.reports = make([]*ActionReport, 0, len(self.actions))
+	self.branches = make([]*BranchReport, 0)
+	self.errors = make([]*ActionError, 0)
+	self.failures = make([]string, 0)
+	if self.checkpoints == nil {
+		self.checkpoints = make(map[string]*straw2.Device)
+	}
+	self.traced = make(map[uint32][]*KeyStep)
+	self.tracedKeys(self.traced)
+	self.last, self.previous = nil, nil
+	for _, v := range self.warnings {
+		renderer.Warning(v)
+	}
+	if sbc != nil {
+		self.track(0, "start", "", sbc)
+	}
+
+	new_sbc, _ := self.runActions(self, renderer, sbc, "")
+	return new_sbc
+}
+
+// runActions runs the actions of self from sbc and records reports,
+// failures and checkpoints in top, which is self unless self is an
+// alternative of a branch. It returns false if the run has to stop.
+func (self *ActionList) runActions(top *ActionList, renderer *Renderer, sbc *straw2.Device, branch string) (*straw2.Device, bool) {
+	new_sbc := sbc
+	for i, v := range self.actions {
+		switch action := v.(type) {
+		case *ActionExpect:
+			if action.Check(new_sbc, top.previous) {
+				renderer.Expect(action, true)
+			} else {
+				renderer.Expect(action, false)
+				top.failures = append(top.failures, action.failure)
+			}
+			continue
+		case *ActionCheckpoint:
+			renderer.Enter(v)
+			top.checkpoints[action.name] = new_sbc
+			continue
+		case *ActionRestore:
+			renderer.Enter(v)
+			device, ok := top.checkpoints[action.name]
+			if !ok || device == nil {
+				err := fmt.Errorf("checkpoint \"%s\": %w", action.name, ErrNoDevice)
+				if !top.fail(renderer, &ActionError{Index: i + 1, Action: FormatAction(v), Branch: branch, Err: err}) {
+					return new_sbc, false
+				}
+				continue
+			}
+			new_sbc = device
+			top.last, top.previous = nil, nil
+			top.track(i+1, FormatAction(v), branch, new_sbc)
+			continue
+		case *ActionVerify:
+			renderer.Enter(v)
+			if _, err := action.Run(new_sbc); err != nil {
+				if !top.fail(renderer, &ActionError{Index: i + 1, Action: FormatAction(v), Branch: branch, Err: err}) {
+					return new_sbc, false
+				}
+				continue
+			}
+			renderer.Verified(new_sbc)
+			continue
+		case *ActionWhere:
+			renderer.Enter(v)
+			var trace *straw2.Trace
+			err := ErrNoDevice
+			if new_sbc != nil {
+				trace, err = new_sbc.Trace(action.key)
+			}
+			if err != nil {
+				if !top.fail(renderer, &ActionError{Index: i + 1, Action: FormatAction(v), Branch: branch, Err: err}) {
+					return new_sbc, false
+				}
+				continue
+			}
+			renderer.Where(trace, top.keySteps(action.key, branch))
+			continue
+		case *ActionMigrationModel:
+			renderer.Enter(v)
+			top.model = &action.model
+			continue
+		case *ActionSave, *ActionExportCrushMap, *ActionExportPlan:
+			// They write a file and leave the device as it is, so there
+			// is no result to render or report. export_plan writes the
+			// moves of the action before even if it was previewed.
+			renderer.Enter(v)
+			device := new_sbc
+			if _, ok := v.(*ActionExportPlan); ok && top.last != nil {
+				device = top.last
+			}
+			if _, err := v.Run(device); err != nil {
+				if !top.fail(renderer, &ActionError{Index: i + 1, Action: FormatAction(v), Branch: branch, Err: err}) {
+					return new_sbc, false
+				}
+			}
+			continue
+		case *ActionBranch:
+			renderer.Enter(v)
+			if !action.RunAlts(top, renderer, i+1, new_sbc, branch) {
+				return new_sbc, false
+			}
+			top.last, top.previous = nil, nil
+			continue
+		}
+
+		renderer.Enter(v)
+		start_time := time.Now()
+		old_sbc := new_sbc
+		var err error
+		new_sbc, err = v.Run(old_sbc)
+		elapsed := time.Since(start_time)
+		if err == nil && new_sbc == nil {
+			err = ErrNoDevice
+		}
+		if err != nil {
+			new_sbc = old_sbc
+			top.last, top.previous = nil, nil
+			if !top.fail(renderer, &ActionError{Index: i + 1, Action: FormatAction(v), Branch: branch, Err: err}) {
+				return new_sbc, false
+			}
+			continue
+		}
+		report := NewActionReport(i+1, v, old_sbc, new_sbc, elapsed)
+		report.Branch = branch
+		if _, ok := v.(*ActionPreview); ok || (top.dryRun && old_sbc != nil) {
+			report.Preview = true
+		}
+		top.reports = append(top.reports, report)
+
+		renderer.Result(new_sbc, elapsed)
+		if top.model != nil && old_sbc != new_sbc {
+			moves := append([]straw2.Move{}, new_sbc.Moves...)
+			straw2.SortMoves(moves)
+			report.Timing = SimulateMigration(moves, top.model)
+			renderer.Timing(report.Timing)
+		}
+		result := new_sbc
+		top.last, top.previous = result, report
+		if report.Preview {
+			renderer.Previewed()
+			new_sbc = old_sbc
+		} else {
+			top.track(i+1, FormatAction(v), branch, new_sbc)
+		}
+
+		if top.verify {
+			if err := VerifyDevice(result); err != nil {
+				if !top.fail(renderer, &ActionError{Index: i + 1, Action: FormatAction(v), Branch: branch, Err: err}) {
+					return new_sbc, false
+				}
+			}
+		}
+	}
+	return new_sbc, true
+}
+
+// fail records err and reports whether the run goes on.
+func (self *ActionList) fail(renderer *Renderer, err *ActionError) bool {
+	renderer.Error(err)
+	self.errors = append(self.errors, err)
+	self.failures = append(self.failures, err.Error())
+	return self.policy == PolicyContinue
+}
+
+func (self *ActionList) Add(action Action) {
+	self.actions = append(self.actions, action)
+}
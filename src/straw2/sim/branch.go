@@ -0,0 +1,268 @@
+package sim
+
+import (
+	"bytes"
+	"fmt"
+
+	"straw2"
+)
+
+type ActionCheckpoint struct {
+	name string
+}
+
+func NewActionCheckpoint(args *ActionArgs) (Action, error) {
+	if len(args.strs["name"]) == 0 {
+		return nil, fmt.Errorf("checkpoint needs a name")
+	}
+	return &ActionCheckpoint{name: args.strs["name"]}, nil
+}
+
+func (self *ActionCheckpoint) Run(sbc *straw2.Device) (*straw2.Device, error) {
+	return sbc, nil
+}
+
+func (self *ActionCheckpoint) Params() map[string]uint32 {
+	return map[string]uint32{}
+}
+
+func (self *ActionCheckpoint) Args() *ActionArgs {
+	args := NewActionArgs(nil)
+	args.strs["name"] = self.name
+	return args
+}
+
+func (self *ActionCheckpoint) Name() string {
+	return "checkpoint"
+}
+
+func (self *ActionCheckpoint) Enter() string {
+	return fmt.Sprintf(Msg("enter_checkpoint"), self.name)
+}
+
+type ActionRestore struct {
+	name string
+}
+
+func NewActionRestore(args *ActionArgs) (Action, error) {
+	if len(args.strs["name"]) == 0 {
+		return nil, fmt.Errorf("restore needs a name")
+	}
+	return &ActionRestore{name: args.strs["name"]}, nil
+}
+
+func (self *ActionRestore) Run(sbc *straw2.Device) (*straw2.Device, error) {
+	return sbc, nil
+}
+
+func (self *ActionRestore) Params() map[string]uint32 {
+	return map[string]uint32{}
+}
+
+func (self *ActionRestore) Args() *ActionArgs {
+	args := NewActionArgs(nil)
+	args.strs["name"] = self.name
+	return args
+}
+
+func (self *ActionRestore) Name() string {
+	return "restore"
+}
+
+func (self *ActionRestore) Enter() string {
+	return fmt.Sprintf(Msg("enter_restore"), self.name)
+}
+
+type BranchAlt struct {
+	name    string
+	actions *ActionList
+}
+
+// ActionBranch runs every alternative from the device it starts with. The
+// device after the branch is the same device, so the branch does not change
+// what the following actions see; restore a checkpoint taken inside an
+// alternative to continue from it.
+type ActionBranch struct {
+	alts []*BranchAlt
+}
+
+func (self *ActionBranch) Run(sbc *straw2.Device) (*straw2.Device, error) {
+	return sbc, nil
+}
+
+func (self *ActionBranch) Params() map[string]uint32 {
+	return map[string]uint32{}
+}
+
+func (self *ActionBranch) Name() string {
+	return "branch"
+}
+
+func (self *ActionBranch) Enter() string {
+	str := fmt.Sprintf("=====================================================================\n")
+	str += fmt.Sprintf(Msg("enter_branch"), len(self.alts))
+	str += fmt.Sprintf("=====================================================================\n")
+	return str
+}
+
+type BranchAltReport struct {
+	Name             string  `json:"name"`
+	Actions          int     `json:"actions"`
+	Total            uint32  `json:"total"`
+	MigrateTotal     uint32  `json:"migrate_total"`
+	MigrateCrossMg   uint32  `json:"migrate_cross_mg"`
+	MgMaxBiasPercent float64 `json:"mg_max_bias_percent"`
+	PeMaxBiasPercent float64 `json:"pe_max_bias_percent"`
+	UseTimeMs        float64 `json:"use_time_ms"`
+}
+
+type BranchReport struct {
+	Index int                `json:"index"`
+	Alts  []*BranchAltReport `json:"alts"`
+}
+
+func NewBranchAltReport(name string, sbc *straw2.Device, reports []*ActionReport) *BranchAltReport {
+	report := &BranchAltReport{Name: name, Actions: len(reports)}
+	for _, v := range reports {
+		report.MigrateTotal += v.MigrateTotal
+		report.MigrateCrossMg += v.MigrateCrossMg
+		report.UseTimeMs += v.UseTimeMs
+	}
+
+	if sbc != nil {
+		sbc.CalcStat()
+		report.Total = sbc.Total
+		report.MgMaxBiasPercent = sbc.Stat.MaxBiasPercent * 100
+		report.PeMaxBiasPercent = sbc.PeMaxBiasPercent() * 100
+	}
+	return report
+}
+
+func (self *BranchReport) String() string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, Msg("branch_compare"), self.Index)
+	fmt.Fprintf(buf, "%-20s %7s %10s %10s %9s %10s %13s %13s %12s\n",
+		"alt", "actions", "total", "migrate", "migrate%", "cross_mg", "mg_max_bias%", "pe_max_bias%", "use_time_ms")
+
+	for _, v := range self.Alts {
+		migrate_percent := float64(0)
+		if v.Total > 0 {
+			migrate_percent = float64(v.MigrateTotal) / float64(v.Total) * 100
+		}
+
+		fmt.Fprintf(buf, "%-20s %7d %10d %10d %8.2f%% %10d %12.2f%% %12.2f%% %12.3f\n",
+			v.Name, v.Actions, v.Total, v.MigrateTotal, migrate_percent, v.MigrateCrossMg,
+			v.MgMaxBiasPercent, v.PeMaxBiasPercent, v.UseTimeMs)
+	}
+	return buf.String()
+}
+
+// RunAlts runs every alternative from sbc and records a report per
+// alternative in top. prefix names the enclosing alternative of a nested
+// branch.
+func (self *ActionBranch) RunAlts(top *ActionList, renderer *Renderer, index int, sbc *straw2.Device, prefix string) bool {
+	report := &BranchReport{Index: index, Alts: make([]*BranchAltReport, 0, len(self.alts))}
+	for _, alt := range self.alts {
+		name := alt.name
+		if len(prefix) > 0 {
+			name = prefix + "/" + alt.name
+		}
+
+		renderer.Alt(name)
+		begin := len(top.reports)
+		top.last, top.previous = nil, nil
+		device, ok := alt.actions.runActions(top, renderer, sbc, name)
+		if !ok {
+			return false
+		}
+		report.Alts = append(report.Alts, NewBranchAltReport(name, device, top.reports[begin:]))
+	}
+
+	top.branches = append(top.branches, report)
+	renderer.Branch(report)
+	return true
+}
+
+// parseBranch parses "branch { alt NAME { ... } ... }".
+func (self *Parser) parseBranch(keyword *Token) bool {
+	if _, ok := self.expect(TokenLBrace); !ok {
+		return false
+	}
+
+	branch := &ActionBranch{}
+	names := make(map[string]bool)
+	actions := self.ctx.actions
+	for {
+		switch self.tok.kind {
+		case TokenNewline:
+			self.next()
+			continue
+		case TokenEOF:
+			self.errorAt(keyword.line, keyword.column, "missing %s for \"%s\"", TokenRBrace, keyword.text)
+			return false
+		}
+
+		if self.tok.kind == TokenRBrace {
+			self.next()
+			break
+		}
+
+		alt, ok := self.expect(TokenIdent)
+		if !ok {
+			return false
+		}
+		if alt.text != "alt" {
+			self.errorAt(alt.line, alt.column, "expected \"alt\", found %s", alt)
+			return false
+		}
+
+		name, ok := self.expect(TokenIdent)
+		if !ok {
+			return false
+		}
+		if names[name.text] {
+			self.errorAt(name.line, name.column, "duplicate alt \"%s\"", name.text)
+		}
+		names[name.text] = true
+
+		if _, ok = self.expect(TokenLBrace); !ok {
+			return false
+		}
+
+		self.ctx.actions = NewActionList()
+		ok = self.parseBlock(alt)
+		branch.alts = append(branch.alts, &BranchAlt{name: name.text, actions: self.ctx.actions})
+		self.ctx.actions = actions
+		if !ok {
+			return false
+		}
+	}
+
+	if len(branch.alts) == 0 {
+		self.errorAt(keyword.line, keyword.column, "branch has no alt")
+		return false
+	}
+
+	self.ctx.actions.Add(branch)
+	return true
+}
+
+// addAction checks that every restore refers to a checkpoint taken before
+// it in the file, and that no action touches files if the context forbids
+// it.
+func (self *Parser) addAction(action Action, line, column int) {
+	if self.ctx.noFiles && touchesFiles(action) {
+		self.errorAt(line, column, "action \"%s\" is not allowed here", action.Name())
+		return
+	}
+	switch v := action.(type) {
+	case *ActionCheckpoint:
+		self.ctx.checkpoints[v.name] = true
+	case *ActionRestore:
+		if !self.ctx.checkpoints[v.name] {
+			self.errorAt(line, column, "restore of unknown checkpoint \"%s\"", v.name)
+			return
+		}
+	}
+	self.ctx.actions.Add(action)
+}
@@ -0,0 +1,441 @@
+package sim
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"straw2"
+)
+
+// Crushmaps are the text written by "crushtool -d". The root bucket becomes
+// the device, its child buckets become MGs and the devices below every child
+// bucket become PEs. Deeper levels are flattened into their MG. Weights keep
+// the CRUSH 16.16 fixed point value, so weight 1.00000 is 65536.
+
+const crushWeightScale = 0x10000
+
+const crushMapHeader = "# begin crush map"
+
+type CrushItem struct {
+	name   string
+	weight uint32
+}
+
+type CrushBucket struct {
+	name  string
+	kind  string
+	id    int64
+	alg   string
+	items []*CrushItem
+	line  int
+}
+
+type CrushDevice struct {
+	id    int64
+	name  string
+	class string
+}
+
+type CrushMap struct {
+	filename string
+	devices  map[string]*CrushDevice
+	buckets  map[string]*CrushBucket
+	order    []string
+}
+
+func IsCrushMap(filename string, src string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".crush", ".crushmap":
+		return true
+	}
+	return strings.HasPrefix(strings.TrimSpace(src), crushMapHeader)
+}
+
+func ParseCrushWeight(str string) (uint32, bool) {
+	val, err := strconv.ParseFloat(str, 64)
+	if err != nil || val < 0 || val*crushWeightScale > math.MaxUint32 {
+		return 0, false
+	}
+	return uint32(math.Round(val * crushWeightScale)), true
+}
+
+func FormatCrushWeight(weight uint32) string {
+	return fmt.Sprintf("%.5f", float64(weight)/crushWeightScale)
+}
+
+func (self *CrushMap) errorAt(errors []*ParseError, line int, format string, args ...interface{}) []*ParseError {
+	return append(errors, &ParseError{filename: self.filename, line: line, column: 1, msg: fmt.Sprintf(format, args...)})
+}
+
+func ParseCrushMap(filename, src string) (*CrushMap, []*ParseError) {
+	crush := &CrushMap{filename: filename, devices: make(map[string]*CrushDevice), buckets: make(map[string]*CrushBucket)}
+	errors := make([]*ParseError, 0)
+
+	var bucket *CrushBucket = nil
+	skip := 0
+	for i, line := range strings.Split(src, "\n") {
+		num := i + 1
+		if index := strings.Index(line, "#"); index >= 0 {
+			line = line[:index]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// rules, choose_args and anything else not needed for placement
+		if skip > 0 {
+			skip += strings.Count(line, "{") - strings.Count(line, "}")
+			continue
+		}
+
+		if bucket != nil {
+			switch {
+			case fields[0] == "}":
+				bucket = nil
+			case fields[0] == "id" && len(fields) == 2:
+				id, err := strconv.ParseInt(fields[1], 10, 64)
+				if err != nil || id >= 0 {
+					errors = crush.errorAt(errors, num, "invalid bucket id \"%s\"", fields[1])
+					continue
+				}
+				bucket.id = id
+			case fields[0] == "id":
+				// shadow bucket id of a device class
+			case fields[0] == "alg" && len(fields) == 2:
+				bucket.alg = fields[1]
+			case fields[0] == "hash":
+			case fields[0] == "item" && len(fields) >= 4 && fields[2] == "weight":
+				weight, ok := ParseCrushWeight(fields[3])
+				if !ok {
+					errors = crush.errorAt(errors, num, "invalid weight \"%s\"", fields[3])
+					continue
+				}
+				bucket.items = append(bucket.items, &CrushItem{name: fields[1], weight: weight})
+			default:
+				errors = crush.errorAt(errors, num, "unexpected \"%s\" in bucket \"%s\"", strings.Join(fields, " "), bucket.name)
+			}
+			continue
+		}
+
+		switch {
+		case fields[0] == "device" && len(fields) >= 3:
+			id, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil || id < 0 || id > math.MaxUint32 {
+				errors = crush.errorAt(errors, num, "invalid device id \"%s\"", fields[1])
+				continue
+			}
+			device := &CrushDevice{id: id, name: fields[2]}
+			if len(fields) == 5 && fields[3] == "class" {
+				device.class = fields[4]
+			}
+			crush.devices[device.name] = device
+		case fields[0] == "tunable" || fields[0] == "type":
+		case len(fields) == 3 && fields[2] == "{" && (fields[0] == "rule" || fields[0] == "choose_args"):
+			skip = 1
+		case len(fields) == 3 && fields[2] == "{":
+			if _, ok := crush.buckets[fields[1]]; ok {
+				errors = crush.errorAt(errors, num, "duplicate bucket \"%s\"", fields[1])
+			}
+			bucket = &CrushBucket{name: fields[1], kind: fields[0], line: num}
+			crush.buckets[bucket.name] = bucket
+			crush.order = append(crush.order, bucket.name)
+		default:
+			errors = crush.errorAt(errors, num, "unexpected \"%s\"", strings.Join(fields, " "))
+		}
+	}
+
+	if bucket != nil {
+		errors = crush.errorAt(errors, bucket.line, "missing \"}\" for bucket \"%s\"", bucket.name)
+	}
+	if len(errors) > 0 {
+		return nil, errors
+	}
+	return crush, nil
+}
+
+// Root returns the bucket named "default", or the only bucket that is not
+// an item of another bucket.
+func (self *CrushMap) Root() (*CrushBucket, error) {
+	if root, ok := self.buckets["default"]; ok {
+		return root, nil
+	}
+
+	children := make(map[string]bool)
+	for _, v := range self.buckets {
+		for _, item := range v.items {
+			children[item.name] = true
+		}
+	}
+
+	roots := make([]string, 0)
+	for _, v := range self.order {
+		if !children[v] {
+			roots = append(roots, v)
+		}
+	}
+
+	if len(roots) != 1 {
+		return nil, fmt.Errorf("cannot choose a root bucket from [%s]", strings.Join(roots, ", "))
+	}
+	return self.buckets[roots[0]], nil
+}
+
+func (self *CrushMap) collectPes(bucket *CrushBucket, mg *TopologyMg, depth int) error {
+	if depth > len(self.buckets) {
+		return fmt.Errorf("bucket \"%s\" contains itself", bucket.name)
+	}
+
+	for _, item := range bucket.items {
+		if device, ok := self.devices[item.name]; ok {
+			labels := map[string]string{"name": device.name}
+			if len(device.class) > 0 {
+				labels["class"] = device.class
+			}
+			mg.pes = append(mg.pes, &TopologyPe{id: uint32(device.id), weight: item.weight, labels: labels})
+			continue
+		}
+
+		child, ok := self.buckets[item.name]
+		if !ok {
+			return fmt.Errorf("unknown item \"%s\" in bucket \"%s\"", item.name, bucket.name)
+		}
+		if err := self.collectPes(child, mg, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *CrushMap) Topology() (*Topology, []error) {
+	root, err := self.Root()
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	topology := &Topology{}
+	errors := make([]error, 0)
+	for _, name := range self.order {
+		if alg := self.buckets[name].alg; alg != "straw2" {
+			topology.warnings = append(topology.warnings, fmt.Sprintf("%s: bucket \"%s\" uses alg %s, simulated as straw2", self.filename, name, alg))
+		}
+	}
+
+	for _, item := range root.items {
+		bucket, ok := self.buckets[item.name]
+		if !ok {
+			errors = append(errors, fmt.Errorf("root \"%s\" item \"%s\" is not a bucket", root.name, item.name))
+			continue
+		}
+
+		mg := &TopologyMg{id: uint32(-bucket.id), labels: map[string]string{"name": bucket.name, "type": bucket.kind}}
+		if err := self.collectPes(bucket, mg, 0); err != nil {
+			errors = append(errors, err)
+			continue
+		}
+		topology.mgs = append(topology.mgs, mg)
+	}
+
+	if len(errors) > 0 {
+		return nil, errors
+	}
+	if errors = topology.Check(); len(errors) > 0 {
+		return nil, errors
+	}
+	return topology, nil
+}
+
+func LoadCrushMap(filename, src string) (*Topology, []*ParseError) {
+	crush, errors := ParseCrushMap(filename, src)
+	if len(errors) > 0 {
+		return nil, errors
+	}
+
+	topology, errs := crush.Topology()
+	for _, v := range errs {
+		errors = append(errors, &ParseError{filename: filename, msg: v.Error()})
+	}
+	if len(errors) > 0 {
+		return nil, errors
+	}
+	return topology, nil
+}
+
+func crushLabel(labels map[string]string, key, def string) string {
+	if v, ok := labels[key]; ok && len(v) > 0 {
+		return v
+	}
+	return def
+}
+
+// FormatCrushMap writes device as a crushmap with one root bucket "default",
+// one bucket per MG and one device per PE. The export is lossy: PE ids are
+// used as device ids only when they are unique across MGs, otherwise
+// devices are renumbered in order and the map says so in a comment; MG ids
+// become bucket ids, except MG 0 which gets a free id; the root gets the
+// next free id rather than its original one, and buckets that were
+// flattened into an MG on import are gone.
+func FormatCrushMap(device *straw2.Device) string {
+	unique := make(map[uint32]bool)
+	for _, mg := range device.Mgs {
+		for _, pe := range mg.Pes {
+			unique[pe.Id] = true
+		}
+	}
+
+	pe_num := 0
+	for _, mg := range device.Mgs {
+		pe_num += len(mg.Pes)
+	}
+	renumber := len(unique) != pe_num
+
+	type crushDeviceOut struct {
+		id    uint32
+		name  string
+		class string
+	}
+
+	devices := make([]*crushDeviceOut, 0, pe_num)
+	names := make(map[*straw2.PE]string)
+	types := []string{"osd"}
+	root_id := uint32(0)
+	for _, mg := range device.Mgs {
+		if mg.Id > root_id {
+			root_id = mg.Id
+		}
+
+		kind := crushLabel(mg.Labels, "type", "host")
+		found := false
+		for _, v := range types {
+			found = found || v == kind
+		}
+		if !found {
+			types = append(types, kind)
+		}
+
+		for _, pe := range mg.Pes {
+			id := pe.Id
+			if renumber {
+				id = uint32(len(devices))
+			}
+
+			name := fmt.Sprintf("osd.%d", id)
+			if !renumber {
+				name = crushLabel(pe.Labels, "name", name)
+			}
+			names[pe] = name
+			devices = append(devices, &crushDeviceOut{id: id, name: name, class: pe.Labels["class"]})
+		}
+	}
+	types = append(types, "root")
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].id < devices[j].id
+	})
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%s\n", crushMapHeader)
+	fmt.Fprintf(buf, "\n# devices\n")
+	if renumber {
+		fmt.Fprintf(buf, "# renumbered: PE ids are not unique across MGs\n")
+	}
+	for _, v := range devices {
+		fmt.Fprintf(buf, "device %d %s", v.id, v.name)
+		if len(v.class) > 0 {
+			fmt.Fprintf(buf, " class %s", v.class)
+		}
+		fmt.Fprintf(buf, "\n")
+	}
+
+	fmt.Fprintf(buf, "\n# types\n")
+	for i, v := range types {
+		fmt.Fprintf(buf, "type %d %s\n", i, v)
+	}
+
+	// Bucket ids are negative, so MG 0 takes the id after the root.
+	bucket_id := func(mg *straw2.MG) int64 {
+		if mg.Id == 0 {
+			return -int64(root_id) - 2
+		}
+		return -int64(mg.Id)
+	}
+
+	fmt.Fprintf(buf, "\n# buckets\n")
+	for _, mg := range device.Mgs {
+		fmt.Fprintf(buf, "%s %s {\n", crushLabel(mg.Labels, "type", "host"), crushLabel(mg.Labels, "name", fmt.Sprintf("mg%d", mg.Id)))
+		fmt.Fprintf(buf, "\tid %d\n", bucket_id(mg))
+		fmt.Fprintf(buf, "\t# weight %s\n", FormatCrushWeight(mg.Weight))
+		fmt.Fprintf(buf, "\talg straw2\n\thash 0\t# rjenkins1\n")
+		for _, pe := range mg.Pes {
+			fmt.Fprintf(buf, "\titem %s weight %s\n", names[pe], FormatCrushWeight(pe.Weight))
+		}
+		fmt.Fprintf(buf, "}\n")
+	}
+
+	root_weight := uint32(0)
+	for _, mg := range device.Mgs {
+		root_weight += mg.Weight
+	}
+
+	fmt.Fprintf(buf, "root default {\n")
+	fmt.Fprintf(buf, "\tid %d\n", -int64(root_id)-1)
+	fmt.Fprintf(buf, "\t# weight %s\n", FormatCrushWeight(root_weight))
+	fmt.Fprintf(buf, "\talg straw2\n\thash 0\t# rjenkins1\n")
+	for _, mg := range device.Mgs {
+		fmt.Fprintf(buf, "\titem %s weight %s\n", crushLabel(mg.Labels, "name", fmt.Sprintf("mg%d", mg.Id)), FormatCrushWeight(mg.Weight))
+	}
+	fmt.Fprintf(buf, "}\n")
+
+	fmt.Fprintf(buf, "\n# rules\n")
+	fmt.Fprintf(buf, "rule replicated_rule {\n\tid 0\n\ttype replicated\n\tstep take default\n")
+	fmt.Fprintf(buf, "\tstep chooseleaf firstn 0 type %s\n\tstep emit\n}\n", types[1])
+	fmt.Fprintf(buf, "\n# end crush map\n")
+	return buf.String()
+}
+
+type ActionExportCrushMap struct {
+	file string
+}
+
+func NewActionExportCrushMap(args *ActionArgs) (Action, error) {
+	if len(args.strs["file"]) == 0 {
+		return nil, fmt.Errorf("export_crushmap needs a file name")
+	}
+	return &ActionExportCrushMap{file: args.strs["file"]}, nil
+}
+
+func (self *ActionExportCrushMap) Run(sbc *straw2.Device) (*straw2.Device, error) {
+	if sbc == nil {
+		return nil, ErrNoDevice
+	}
+	if err := WriteFile(self.file, FormatCrushMap(sbc)); err != nil {
+		return sbc, err
+	}
+	return sbc, nil
+}
+
+func (self *ActionExportCrushMap) Params() map[string]uint32 {
+	return map[string]uint32{}
+}
+
+func (self *ActionExportCrushMap) Args() *ActionArgs {
+	args := NewActionArgs(nil)
+	args.strs["file"] = self.file
+	return args
+}
+
+func (self *ActionExportCrushMap) Name() string {
+	return "export_crushmap"
+}
+
+func (self *ActionExportCrushMap) Enter() string {
+	str := fmt.Sprintf("---------------------------------------------------------------------\n")
+	str += fmt.Sprintf(Msg("enter_export_crushmap"), self.file)
+	str += fmt.Sprintf("---------------------------------------------------------------------\n")
+	return str
+}
@@ -0,0 +1,84 @@
+package sim_test
+
+import (
+	"fmt"
+	"os"
+
+	"straw2"
+	"straw2/sim"
+)
+
+// ActionScaleOutMany adds count MGs numbered from first_id, each with
+// pe_num PEs.
+type ActionScaleOutMany struct {
+	first_id uint32
+	count    uint32
+	pe_num   uint32
+	label    string
+}
+
+func (self *ActionScaleOutMany) Run(sbc *straw2.Device) (*straw2.Device, error) {
+	device := sbc
+	for i := uint32(0); i < self.count; i++ {
+		var err error
+		if device, err = device.ScaleOutMg(self.first_id+i, self.pe_num, 1); err != nil {
+			return nil, err
+		}
+	}
+	return device, nil
+}
+
+func (self *ActionScaleOutMany) Params() map[string]uint32 {
+	return map[string]uint32{"first_id": self.first_id, "count": self.count, "pe_num": self.pe_num}
+}
+
+func (self *ActionScaleOutMany) Args() *sim.ActionArgs {
+	args := sim.NewActionArgs(self.Params())
+	args.SetString("label", self.label)
+	return args
+}
+
+func (self *ActionScaleOutMany) Name() string {
+	return "scale_out_many"
+}
+
+func (self *ActionScaleOutMany) Enter() string {
+	return fmt.Sprintf("Scale out %d MGs from MG[%d]: %s\n", self.count, self.first_id, self.label)
+}
+
+func ExampleRegisterAction() {
+	sim.RegisterAction(&sim.ActionSpec{
+		Name: "scale_out_many",
+		Help: "add several MGs at once",
+		Params: []*sim.ParamSpec{
+			{Name: "first_id", Help: "id of the first new MG"},
+			{Name: "count", Help: "number of new MGs", Min: 1},
+			{Name: "pe_num", Help: "number of PEs in every new MG", Default: 2, HasDefault: true, Min: 1},
+			{Name: "label", Help: "what the change is for", Kind: sim.ParamString},
+		},
+		New: func(args *sim.ActionArgs) (sim.Action, error) {
+			action := &ActionScaleOutMany{}
+			action.first_id, _ = args.Uint32("first_id")
+			action.count, _ = args.Uint32("count")
+			action.pe_num, _ = args.Uint32("pe_num")
+			action.label, _ = args.String("label")
+			return action, nil
+		},
+	})
+
+	actions, errors := sim.ParseActions("example.cfg", `
+power_on: rands_num = 1000, mg_num = 2, pe_num = 2
+scale_out_many: first_id = 10, count = 3, label = "new rack"
+`)
+	if len(errors) > 0 {
+		fmt.Println(errors)
+		return
+	}
+	device := actions.Run(sim.NewRenderer(sim.VerbositySummary))
+	actions.Expand(os.Stdout)
+	fmt.Println(len(device.Mgs), device.Total)
+	// Output:
+	// power_on: rands_num = 1000, mg_num = 2, pe_num = 2, pe_weight = 1
+	// scale_out_many: first_id = 10, count = 3, pe_num = 2, label = "new rack"
+	// 5 1000
+}
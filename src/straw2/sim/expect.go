@@ -0,0 +1,280 @@
+package sim
+
+import (
+	"fmt"
+	"strconv"
+
+	"straw2"
+)
+
+var deviceMetrics = []string{"total", "weight", "mg_num", "migrate_total", "migrate_cross_mg",
+	"avg_bias_percent", "max_bias_percent", "pe_max_bias_percent"}
+
+var mgMetrics = []string{"total", "weight", "pe_num", "migrate_in", "migrate_out", "avg_bias_percent", "max_bias_percent"}
+
+var peMetrics = []string{"count", "weight", "migrate_in", "migrate_out"}
+
+func findMetric(metrics []string, name string) bool {
+	for _, v := range metrics {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+type ExpectEnv struct {
+	device *straw2.Device
+	report *ActionReport
+}
+
+type ExprNode interface {
+	Eval(env *ExpectEnv) (float64, error)
+	String() string
+}
+
+type ExprNumber struct {
+	val float64
+}
+
+func (self *ExprNumber) Eval(env *ExpectEnv) (float64, error) {
+	return self.val, nil
+}
+
+func (self *ExprNumber) String() string {
+	return strconv.FormatFloat(self.val, 'g', -1, 64)
+}
+
+type ExprMetric struct {
+	name   string
+	mg_id  uint32
+	pe_id  uint32
+	has_mg bool
+	has_pe bool
+}
+
+func (self *ExprMetric) String() string {
+	switch {
+	case self.has_pe:
+		return fmt.Sprintf("mg[%d].pe[%d].%s", self.mg_id, self.pe_id, self.name)
+	case self.has_mg:
+		return fmt.Sprintf("mg[%d].%s", self.mg_id, self.name)
+	}
+	return self.name
+}
+
+func (self *ExprMetric) Eval(env *ExpectEnv) (float64, error) {
+	device := env.device
+	if device == nil {
+		return 0, fmt.Errorf("no device before expect")
+	}
+
+	if !self.has_mg {
+		switch self.name {
+		case "total":
+			return float64(device.Total), nil
+		case "weight":
+			return float64(device.Weight), nil
+		case "mg_num":
+			return float64(device.Size()), nil
+		case "migrate_total", "migrate_cross_mg":
+			if env.report == nil {
+				return 0, fmt.Errorf("no previous action result")
+			}
+			if self.name == "migrate_total" {
+				return float64(env.report.MigrateTotal), nil
+			}
+			return float64(env.report.MigrateCrossMg), nil
+		case "avg_bias_percent":
+			return device.Stat.AverageBiasPercent * 100, nil
+		case "max_bias_percent":
+			return device.Stat.MaxBiasPercent * 100, nil
+		case "pe_max_bias_percent":
+			return device.PeMaxBiasPercent() * 100, nil
+		}
+		return 0, fmt.Errorf("unknown metric \"%s\"", self.name)
+	}
+
+	mg_index, err := device.GetMgIndex(self.mg_id)
+	if err != nil {
+		return 0, fmt.Errorf("MG[%d] not found", self.mg_id)
+	}
+	mg := device.Mgs[mg_index]
+
+	if !self.has_pe {
+		switch self.name {
+		case "total":
+			return float64(mg.Total), nil
+		case "weight":
+			return float64(mg.Weight), nil
+		case "pe_num":
+			return float64(mg.Size()), nil
+		case "migrate_in":
+			return float64(mg.Migrate.MigrateIn), nil
+		case "migrate_out":
+			return float64(mg.Migrate.MigrateOut), nil
+		case "avg_bias_percent":
+			return mg.Stat.AverageBiasPercent * 100, nil
+		case "max_bias_percent":
+			return mg.Stat.MaxBiasPercent * 100, nil
+		}
+		return 0, fmt.Errorf("unknown MG metric \"%s\"", self.name)
+	}
+
+	pe_index, err := mg.GetPeIndex(self.pe_id)
+	if err != nil {
+		return 0, fmt.Errorf("MG[%d] PE[%d] not found", self.mg_id, self.pe_id)
+	}
+	pe := mg.Pes[pe_index]
+
+	switch self.name {
+	case "count":
+		return float64(len(pe.Data)), nil
+	case "weight":
+		return float64(pe.Weight), nil
+	case "migrate_in":
+		return float64(pe.Migrate.MigrateIn), nil
+	case "migrate_out":
+		return float64(pe.Migrate.MigrateOut), nil
+	}
+	return 0, fmt.Errorf("unknown PE metric \"%s\"", self.name)
+}
+
+type ExprBinary struct {
+	op    TokenKind
+	left  ExprNode
+	right ExprNode
+}
+
+func (self *ExprBinary) String() string {
+	return fmt.Sprintf("%s %s %s", exprString(self.left), opText[self.op], exprString(self.right))
+}
+
+func exprString(node ExprNode) string {
+	if _, ok := node.(*ExprBinary); ok {
+		return "(" + node.String() + ")"
+	}
+	return node.String()
+}
+
+func (self *ExprBinary) Eval(env *ExpectEnv) (float64, error) {
+	left, err := self.left.Eval(env)
+	if err != nil {
+		return 0, err
+	}
+
+	right, err := self.right.Eval(env)
+	if err != nil {
+		return 0, err
+	}
+
+	switch self.op {
+	case TokenPlus:
+		return left + right, nil
+	case TokenMinus:
+		return left - right, nil
+	case TokenStar:
+		return left * right, nil
+	case TokenSlash:
+		if right == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return left / right, nil
+	}
+	return 0, fmt.Errorf("unknown operator %s", self.op)
+}
+
+var opText = map[TokenKind]string{
+	TokenPlus:         "+",
+	TokenMinus:        "-",
+	TokenStar:         "*",
+	TokenSlash:        "/",
+	TokenLess:         "<",
+	TokenLessEqual:    "<=",
+	TokenGreater:      ">",
+	TokenGreaterEqual: ">=",
+	TokenEqualEqual:   "==",
+	TokenNotEqual:     "!=",
+}
+
+type ExpectCond struct {
+	op    TokenKind
+	left  ExprNode
+	right ExprNode
+}
+
+func (self *ExpectCond) String() string {
+	return fmt.Sprintf("%s %s %s", self.left, opText[self.op], self.right)
+}
+
+func (self *ExpectCond) Eval(env *ExpectEnv) (bool, float64, float64, error) {
+	left, err := self.left.Eval(env)
+	if err != nil {
+		return false, 0, 0, err
+	}
+
+	right, err := self.right.Eval(env)
+	if err != nil {
+		return false, left, 0, err
+	}
+
+	switch self.op {
+	case TokenLess:
+		return left < right, left, right, nil
+	case TokenLessEqual:
+		return left <= right, left, right, nil
+	case TokenGreater:
+		return left > right, left, right, nil
+	case TokenGreaterEqual:
+		return left >= right, left, right, nil
+	case TokenEqualEqual:
+		return left == right, left, right, nil
+	case TokenNotEqual:
+		return left != right, left, right, nil
+	}
+	return false, left, right, fmt.Errorf("unknown comparison %s", self.op)
+}
+
+type ActionExpect struct {
+	cond     *ExpectCond
+	filename string
+	line     int
+	column   int
+	failure  string
+}
+
+func (self *ActionExpect) Run(sbc *straw2.Device) (*straw2.Device, error) {
+	return sbc, nil
+}
+
+func (self *ActionExpect) Check(sbc *straw2.Device, report *ActionReport) bool {
+	self.failure = ""
+	if sbc != nil {
+		sbc.CalcStat()
+	}
+
+	ok, left, right, err := self.cond.Eval(&ExpectEnv{device: sbc, report: report})
+	if err != nil {
+		self.failure = fmt.Sprintf("%s:%d:%d: expect %s: %v", self.filename, self.line, self.column, self.cond, err)
+		return false
+	}
+
+	if !ok {
+		self.failure = fmt.Sprintf("%s:%d:%d: expect %s failed: %s = %g, %s = %g",
+			self.filename, self.line, self.column, self.cond, self.cond.left, left, self.cond.right, right)
+		return false
+	}
+	return true
+}
+
+func (self *ActionExpect) Params() map[string]uint32 {
+	return map[string]uint32{}
+}
+
+func (self *ActionExpect) Name() string {
+	return "expect"
+}
+
+func (self *ActionExpect) Enter() string {
+	return fmt.Sprintf("expect: %s\n", self.cond)
+}
@@ -0,0 +1,236 @@
+package sim
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"math"
+	"sort"
+
+	"straw2"
+)
+
+const (
+	chartWidth   = 960
+	chartHeight  = 240
+	chartMargin  = 40
+	heatmapCell  = 28
+	heatmapLabel = 48
+)
+
+const htmlHead = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>straw2 report</title>
+<style>
+body { font-family: sans-serif; margin: 24px; color: #222; }
+h1, h2, h3 { font-weight: normal; }
+table { border-collapse: collapse; margin: 8px 0; }
+td, th { border: 1px solid #ccc; padding: 2px 8px; text-align: right; }
+svg { display: block; margin: 8px 0 24px 0; }
+svg text { font-size: 10px; }
+.count { fill: #4a78b5; }
+.target { stroke: #d9534f; stroke-width: 2; }
+.line { fill: none; stroke: #d9534f; stroke-width: 2; }
+.axis { stroke: #888; }
+</style>
+</head>
+<body>
+`
+
+type HtmlBar struct {
+	label  string
+	value  float64
+	target float64
+}
+
+func HtmlBarChart(buf *bytes.Buffer, title string, bars []*HtmlBar) {
+	fmt.Fprintf(buf, "<h3>%s</h3>\n", html.EscapeString(title))
+	if len(bars) == 0 {
+		return
+	}
+
+	max := float64(0)
+	for _, bar := range bars {
+		max = math.Max(max, math.Max(bar.value, bar.target))
+	}
+	if max == 0 {
+		max = 1
+	}
+
+	plot_width := float64(chartWidth - 2*chartMargin)
+	plot_height := float64(chartHeight - 2*chartMargin)
+	step := plot_width / float64(len(bars))
+	bar_width := math.Max(step*0.8, 1)
+	label_every := int(math.Ceil(float64(len(bars)) * 24 / plot_width))
+
+	fmt.Fprintf(buf, "<svg width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\">\n", chartWidth, chartHeight, chartWidth, chartHeight)
+	fmt.Fprintf(buf, "<line class=\"axis\" x1=\"%d\" y1=\"%d\" x2=\"%d\" y2=\"%d\"/>\n",
+		chartMargin, chartHeight-chartMargin, chartWidth-chartMargin, chartHeight-chartMargin)
+	fmt.Fprintf(buf, "<text x=\"2\" y=\"%d\">%.0f</text>\n", chartMargin, max)
+
+	for i, bar := range bars {
+		x := float64(chartMargin) + float64(i)*step
+		h := bar.value / max * plot_height
+		y := float64(chartHeight-chartMargin) - h
+		fmt.Fprintf(buf, "<rect class=\"count\" x=\"%.2f\" y=\"%.2f\" width=\"%.2f\" height=\"%.2f\"><title>%s: %.0f (%s %.1f)</title></rect>\n",
+			x, y, bar_width, h, html.EscapeString(bar.label), bar.value, html.EscapeString(Msg("html_target")), bar.target)
+
+		ty := float64(chartHeight-chartMargin) - bar.target/max*plot_height
+		fmt.Fprintf(buf, "<line class=\"target\" x1=\"%.2f\" y1=\"%.2f\" x2=\"%.2f\" y2=\"%.2f\"/>\n", x, ty, x+bar_width, ty)
+
+		if i%label_every == 0 {
+			fmt.Fprintf(buf, "<text x=\"%.2f\" y=\"%d\">%s</text>\n", x, chartHeight-chartMargin+12, html.EscapeString(bar.label))
+		}
+	}
+	buf.WriteString("</svg>\n")
+}
+
+func HtmlLineChart(buf *bytes.Buffer, title, unit string, labels []string, values []float64) {
+	fmt.Fprintf(buf, "<h3>%s</h3>\n", html.EscapeString(title))
+	if len(values) == 0 {
+		return
+	}
+
+	max := float64(0)
+	for _, v := range values {
+		max = math.Max(max, v)
+	}
+	if max == 0 {
+		max = 1
+	}
+
+	plot_width := float64(chartWidth - 2*chartMargin)
+	plot_height := float64(chartHeight - 2*chartMargin)
+	step := plot_width
+	if len(values) > 1 {
+		step = plot_width / float64(len(values)-1)
+	}
+
+	fmt.Fprintf(buf, "<svg width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\">\n", chartWidth, chartHeight, chartWidth, chartHeight)
+	fmt.Fprintf(buf, "<line class=\"axis\" x1=\"%d\" y1=\"%d\" x2=\"%d\" y2=\"%d\"/>\n",
+		chartMargin, chartHeight-chartMargin, chartWidth-chartMargin, chartHeight-chartMargin)
+	fmt.Fprintf(buf, "<text x=\"2\" y=\"%d\">%.2f%s</text>\n", chartMargin, max, html.EscapeString(unit))
+
+	points := ""
+	for i, v := range values {
+		x := float64(chartMargin) + float64(i)*step
+		y := float64(chartHeight-chartMargin) - v/max*plot_height
+		points += fmt.Sprintf("%.2f,%.2f ", x, y)
+		fmt.Fprintf(buf, "<circle cx=\"%.2f\" cy=\"%.2f\" r=\"3\"><title>%s: %.2f%s</title></circle>\n",
+			x, y, html.EscapeString(labels[i]), v, html.EscapeString(unit))
+		fmt.Fprintf(buf, "<text x=\"%.2f\" y=\"%d\">%s</text>\n", x, chartHeight-chartMargin+12, html.EscapeString(labels[i]))
+	}
+	fmt.Fprintf(buf, "<polyline class=\"line\" points=\"%s\"/>\n", points)
+	buf.WriteString("</svg>\n")
+}
+
+func HtmlHeatmap(buf *bytes.Buffer, title string, matrix []*MigrateReport) {
+	fmt.Fprintf(buf, "<h3>%s</h3>\n", html.EscapeString(title))
+	if len(matrix) == 0 {
+		fmt.Fprintf(buf, "<p>%s</p>\n", html.EscapeString(Msg("html_no_migrate")))
+		return
+	}
+
+	id_set := make(map[uint32]bool)
+	max := uint32(0)
+	counts := make(map[straw2.MigrateKey]uint32)
+	for _, v := range matrix {
+		id_set[v.FromMgId] = true
+		id_set[v.ToMgId] = true
+		counts[straw2.MigrateKey{FromMgId: v.FromMgId, ToMgId: v.ToMgId}] = v.Count
+		if v.Count > max {
+			max = v.Count
+		}
+	}
+
+	ids := make([]uint32, 0, len(id_set))
+	for id, _ := range id_set {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	size := heatmapLabel + heatmapCell*len(ids)
+	fmt.Fprintf(buf, "<svg width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\">\n", size, size, size, size)
+	for i, id := range ids {
+		pos := heatmapLabel + heatmapCell*i
+		fmt.Fprintf(buf, "<text x=\"%d\" y=\"%d\">%d</text>\n", pos+4, heatmapLabel-6, id)
+		fmt.Fprintf(buf, "<text x=\"4\" y=\"%d\">%d</text>\n", pos+heatmapCell/2+4, id)
+	}
+
+	for i, from := range ids {
+		for j, to := range ids {
+			count := counts[straw2.MigrateKey{FromMgId: from, ToMgId: to}]
+			opacity := float64(count) / float64(max)
+			fmt.Fprintf(buf, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"#d9534f\" fill-opacity=\"%.3f\" stroke=\"#eee\"><title>MG[%d] -&gt; MG[%d]: %d</title></rect>\n",
+				heatmapLabel+heatmapCell*j, heatmapLabel+heatmapCell*i, heatmapCell, heatmapCell, opacity, from, to, count)
+		}
+	}
+	buf.WriteString("</svg>\n")
+}
+
+func (self *RunReport) Html() string {
+	buf := &bytes.Buffer{}
+	buf.WriteString(htmlHead)
+	fmt.Fprintf(buf, "<h1>%s</h1>\n", html.EscapeString(fmt.Sprintf(Msg("html_title"), self.ActionsFile)))
+
+	labels := make([]string, 0, len(self.Actions))
+	migrates := make([]float64, 0, len(self.Actions))
+	mg_biases := make([]float64, 0, len(self.Actions))
+	pe_biases := make([]float64, 0, len(self.Actions))
+	for _, action := range self.Actions {
+		labels = append(labels, action.Label())
+		migrates = append(migrates, float64(action.MigrateTotal))
+		mg_biases = append(mg_biases, action.Device.Stat.MaxBiasPercent)
+
+		pe_bias := float64(0)
+		for _, mg := range action.Device.Mgs {
+			pe_bias = math.Max(pe_bias, mg.Stat.MaxBiasPercent)
+		}
+		pe_biases = append(pe_biases, pe_bias)
+	}
+
+	fmt.Fprintf(buf, "<h2>%s</h2>\n", html.EscapeString(Msg("html_timeline")))
+	HtmlLineChart(buf, Msg("html_migrate_line"), "", labels, migrates)
+	HtmlLineChart(buf, Msg("html_mg_bias_line"), "%", labels, mg_biases)
+	HtmlLineChart(buf, Msg("html_pe_bias_line"), "%", labels, pe_biases)
+
+	for _, action := range self.Actions {
+		device := action.Device
+		fmt.Fprintf(buf, "<h2>%s: %s</h2>\n", html.EscapeString(action.Label()), html.EscapeString(FormatParams(action.Params)))
+
+		buf.WriteString("<table>\n<tr>")
+		for _, key := range []string{"html_total", "html_migrate", "html_cross_mg", "html_mg_avg_bias", "html_mg_max_bias", "html_use_time"} {
+			fmt.Fprintf(buf, "<th>%s</th>", html.EscapeString(Msg(key)))
+		}
+		buf.WriteString("</tr>\n")
+		fmt.Fprintf(buf, "<tr><td>%d</td><td>%d</td><td>%d</td><td>%.2f%%</td><td>%.2f%%</td><td>%.3f ms</td></tr>\n</table>\n",
+			device.Total, action.MigrateTotal, action.MigrateCrossMg, device.Stat.AverageBiasPercent, device.Stat.MaxBiasPercent, action.UseTimeMs)
+
+		mg_bars := make([]*HtmlBar, 0, len(device.Mgs))
+		pe_bars := make([]*HtmlBar, 0)
+		for _, mg := range device.Mgs {
+			target := float64(0)
+			if device.Weight > 0 {
+				target = float64(device.Total) * float64(mg.Weight) / float64(device.Weight)
+			}
+			mg_bars = append(mg_bars, &HtmlBar{label: fmt.Sprintf("%d", mg.Id), value: float64(mg.Total), target: target})
+
+			for _, pe := range mg.Pes {
+				target := float64(0)
+				if mg.Weight > 0 {
+					target = float64(mg.Total) * float64(pe.Weight) / float64(mg.Weight)
+				}
+				pe_bars = append(pe_bars, &HtmlBar{label: fmt.Sprintf("%d.%d", mg.Id, pe.Id), value: float64(pe.Count), target: target})
+			}
+		}
+
+		HtmlBarChart(buf, Msg("html_mg_bars"), mg_bars)
+		HtmlBarChart(buf, Msg("html_pe_bars"), pe_bars)
+		HtmlHeatmap(buf, Msg("html_heatmap"), action.MigrateMatrix)
+	}
+
+	buf.WriteString("</body>\n</html>\n")
+	return buf.String()
+}
@@ -0,0 +1,264 @@
+package sim
+
+import (
+	"sort"
+)
+
+const (
+	LangEn = "en"
+	LangZh = "zh"
+)
+
+var currentLang = LangEn
+
+var catalog = map[string]map[string]string{
+	LangEn: {
+		"stat":                    "average bias = %2.2f, average bias percent = %2.2f%%, max bias = %d, max bias percent = %2.2f%%",
+		"migrate":                 "migrate in = %d, migrate out = %d",
+		"pe_simple_info":          "PE[%d]: counts = %d, %s\n",
+		"pe_count":                "PE[%d]: counts = %d\n",
+		"pe_weight":               "PE[%d]: weight = %d\n",
+		"pe_data":                 "PE[%d]: data = [",
+		"mg_total_migrate":        "MG[%d]: total = %d, %s\n",
+		"mg_total":                "MG[%d]: total = %d\n",
+		"mg_weight":               "MG[%d]: weight = %d\n",
+		"device_total":            "Device[%d]: total = %d\n",
+		"device_weight":           "Device[%d]: weight = %d\n",
+		"enter_power_on":          "Power On: Rand_Num = %d, MG_Num = %d PE_Num = %d, PE_Weight = %d\n",
+		"enter_power_on_topology": "Power On: Rand_Num = %d, topology with %d MGs and %d PEs\n",
+		"enter_scale_out":         "Scale out: add MG[%d], PE_Num = %d, PE_Weight = %d\n",
+		"enter_scale_in":          "Scale in: del MG[%d]\n",
+		"enter_scale_up":          "Scale up: add MG[%d], PE[%d], PE_Weight = %d\n",
+		"enter_scale_down":        "Scale down: del MG[%d] PE[%d]\n",
+		"enter_reweight":          "Reweight: MG[%d] PE[%d], PE_Weight = %d\n",
+		"enter_export_crushmap":   "Export crushmap: %s\n",
+		"enter_export_plan":       "Export plan: %s, limit = %d\n",
+		"enter_save":              "Save state: %s\n",
+		"enter_load":              "Load state: %s\n",
+		"enter_checkpoint":        "Checkpoint: %s\n",
+		"enter_restore":           "Restore checkpoint: %s\n",
+		"enter_verify":            "Verify device\n",
+		"verify_ok":               "verify: %d keys ... ok\n",
+		"preview_discarded":       "preview: device discarded, next action starts from the device before\n",
+		"enter_migration_model":   "Migration model: key_size = %d KiB, pe_bandwidth = %d MiB/s, mg_bandwidth = %d MiB/s, max_backfills = %d\n",
+		"timing":                  "migration: %d keys, %.2f GiB, done in %s\n",
+		"timing_busiest":          "busiest PE: MG[%d] PE[%d], busy %s with %d moves\n",
+		"enter_where":             "Where: key %d\n",
+		"trace_key":               "key %d: MG[%d] PE[%d], stored = %v\n",
+		"trace_mg_bucket":         "MG bucket, %d items:\n",
+		"trace_pe_bucket":         "PE bucket of MG[%d], %d items:\n",
+		"trace_history":           "key %d history:\n",
+		"enter_branch":            "Branch into %d alternatives\n",
+		"branch_alt":              "--- alt %s ---\n",
+		"branch_compare":          "Branch at action %d:\n",
+		"use_time":                "use time: %v\n",
+		"expect_ok":               "expect: %s ... ok\n",
+		"expect_failed":           "expect: %s ... FAILED\n",
+		"action_error":            "ERROR: %v\n",
+		"warning":                 "WARNING: %s\n",
+		"html_title":              "straw2 report: %s",
+		"html_timeline":           "Timeline",
+		"html_migrate_line":       "Migrated keys per action",
+		"html_mg_bias_line":       "Max MG bias per action",
+		"html_pe_bias_line":       "Max PE bias per action",
+		"html_mg_bars":            "MG counts against weight target",
+		"html_pe_bars":            "PE counts against weight target",
+		"html_heatmap":            "Migration between MGs (row: from, column: to)",
+		"html_no_migrate":         "no migration",
+		"html_target":             "target",
+		"html_total":              "total",
+		"html_migrate":            "migrate",
+		"html_cross_mg":           "cross MG",
+		"html_mg_avg_bias":        "MG avg bias",
+		"html_mg_max_bias":        "MG max bias",
+		"html_use_time":           "use time",
+	},
+	LangZh: {
+		"stat":                    "平均偏差（个）= %2.2f, 平均偏差百分比（%%）= %2.2f%%, 最大偏差（个）= %d, 最大偏差百分比（%%）= %2.2f%%",
+		"migrate":                 "迁入 = %d, 迁出 = %d",
+		"pe_simple_info":          "PE[%d]: 数量 = %d, %s\n",
+		"pe_count":                "PE[%d]: 数量 = %d\n",
+		"pe_weight":               "PE[%d]: 权重 = %d\n",
+		"pe_data":                 "PE[%d]: 数据 = [",
+		"mg_total_migrate":        "MG[%d]: 总数 = %d, %s\n",
+		"mg_total":                "MG[%d]: 总数 = %d\n",
+		"mg_weight":               "MG[%d]: 权重 = %d\n",
+		"device_total":            "Device[%d]: 总数 = %d\n",
+		"device_weight":           "Device[%d]: 权重 = %d\n",
+		"enter_power_on":          "上电: 随机数个数 = %d, MG个数 = %d, PE个数 = %d, PE权重 = %d\n",
+		"enter_power_on_topology": "上电: 随机数个数 = %d, 拓扑包含 %d 个MG, %d 个PE\n",
+		"enter_scale_out":         "扩容MG: 增加 MG[%d], PE个数 = %d, PE权重 = %d\n",
+		"enter_scale_in":          "缩容MG: 删除 MG[%d]\n",
+		"enter_scale_up":          "扩容PE: 增加 MG[%d] PE[%d], PE权重 = %d\n",
+		"enter_scale_down":        "缩容PE: 删除 MG[%d] PE[%d]\n",
+		"enter_reweight":          "调整权重: MG[%d] PE[%d], PE权重 = %d\n",
+		"enter_export_crushmap":   "导出crushmap: %s\n",
+		"enter_export_plan":       "导出迁移计划: %s, 限制 = %d\n",
+		"enter_save":              "保存状态: %s\n",
+		"enter_load":              "加载状态: %s\n",
+		"enter_checkpoint":        "保存检查点: %s\n",
+		"enter_restore":           "恢复检查点: %s\n",
+		"enter_verify":            "校验设备\n",
+		"verify_ok":               "校验: %d 个键 ... 通过\n",
+		"preview_discarded":       "预览: 已丢弃设备, 下一个动作从之前的设备开始\n",
+		"enter_migration_model":   "迁移模型: 键大小 = %d KiB, PE带宽 = %d MiB/s, MG带宽 = %d MiB/s, 最大并发回填 = %d\n",
+		"timing":                  "迁移: %d 个键, %.2f GiB, 耗时 %s\n",
+		"timing_busiest":          "最繁忙PE: MG[%d] PE[%d], 忙碌 %s, 共 %d 次迁移\n",
+		"enter_where":             "定位: 键 %d\n",
+		"trace_key":               "键 %d: MG[%d] PE[%d], 已存储 = %v\n",
+		"trace_mg_bucket":         "MG桶, %d 项:\n",
+		"trace_pe_bucket":         "MG[%d] 的PE桶, %d 项:\n",
+		"trace_history":           "键 %d 的历史:\n",
+		"enter_branch":            "分支为%d个备选方案\n",
+		"branch_alt":              "--- 备选方案 %s ---\n",
+		"branch_compare":          "动作%d处的分支对比:\n",
+		"use_time":                "耗时: %v\n",
+		"expect_ok":               "检查: %s ... 通过\n",
+		"expect_failed":           "检查: %s ... 失败\n",
+		"action_error":            "错误: %v\n",
+		"warning":                 "警告: %s\n",
+		"html_title":              "straw2 报告: %s",
+		"html_timeline":           "时间线",
+		"html_migrate_line":       "每个动作的迁移数量",
+		"html_mg_bias_line":       "每个动作的MG最大偏差",
+		"html_pe_bias_line":       "每个动作的PE最大偏差",
+		"html_mg_bars":            "MG数量与权重目标",
+		"html_pe_bars":            "PE数量与权重目标",
+		"html_heatmap":            "MG之间的迁移（行: 迁出, 列: 迁入）",
+		"html_no_migrate":         "无迁移",
+		"html_target":             "目标",
+		"html_total":              "总数",
+		"html_migrate":            "迁移",
+		"html_cross_mg":           "跨MG迁移",
+		"html_mg_avg_bias":        "MG平均偏差",
+		"html_mg_max_bias":        "MG最大偏差",
+		"html_use_time":           "耗时",
+	},
+}
+
+var fieldCatalog = map[string]map[string]string{
+	LangEn: {
+		"version":              "report schema version",
+		"actions_file":         "actions file the report was produced from",
+		"actions":              "executed actions in order",
+		"index":                "1-based position of the action in the action list",
+		"name":                 "action name",
+		"params":               "action parameters",
+		"use_time_ms":          "time used by the action in milliseconds",
+		"migrate_total":        "keys moved by the action, including moves between PEs of the same MG",
+		"migrate_cross_mg":     "keys moved by the action between different MGs",
+		"migrate_matrix":       "keys moved by the action from one MG to another",
+		"from_mg_id":           "MG the keys moved out of",
+		"to_mg_id":             "MG the keys moved into",
+		"count":                "number of keys",
+		"device":               "device state after the action",
+		"mgs":                  "MGs of the device",
+		"pes":                  "PEs of the MG",
+		"id":                   "id",
+		"weight":               "weight",
+		"total":                "number of keys",
+		"migrate_in":           "keys migrated in, accumulated since power on",
+		"migrate_out":          "keys migrated out, accumulated since power on",
+		"labels":               "labels from the topology",
+		"stat":                 "distribution against weight-proportional targets",
+		"average_bias":         "average bias in keys",
+		"average_bias_percent": "average bias in percent of target",
+		"max_bias":             "max bias in keys",
+		"max_bias_percent":     "max bias in percent of target",
+		"branch":               "alternative of the branch the action ran in",
+		"branches":             "comparison of the alternatives of every branch",
+		"alts":                 "alternatives of the branch",
+		"mg_max_bias_percent":  "max MG bias in percent after the alternative",
+		"pe_max_bias_percent":  "max PE bias in percent after the alternative",
+		"errors":               "actions that failed, with the error",
+		"error":                "error returned by the action",
+		"preview":              "the action was previewed, the next action starts from the device before it",
+		"timing":               "simulated duration of the moves of the action under the migration model",
+		"seconds":              "simulated seconds",
+		"moves":                "number of keys moved",
+		"bytes":                "bytes moved",
+		"busiest_mg_id":        "MG of the PE busy the longest",
+		"busiest_pe_id":        "PE busy the longest",
+		"busiest_seconds":      "seconds the busiest PE had a move running",
+		"busiest_moves":        "moves the busiest PE took part in",
+		"progress":             "keys moved over time",
+		"moved":                "keys moved by then",
+		"percent":              "percent of the keys moved by then",
+	},
+	LangZh: {
+		"version":              "报告格式版本",
+		"actions_file":         "生成报告的动作文件",
+		"actions":              "按顺序执行的动作",
+		"index":                "动作在动作列表中的序号（从1开始）",
+		"name":                 "动作名称",
+		"params":               "动作参数",
+		"use_time_ms":          "动作耗时（毫秒）",
+		"migrate_total":        "动作迁移的数量，包括同一MG内PE之间的迁移",
+		"migrate_cross_mg":     "动作在不同MG之间迁移的数量",
+		"migrate_matrix":       "动作从一个MG迁移到另一个MG的数量",
+		"from_mg_id":           "迁出的MG",
+		"to_mg_id":             "迁入的MG",
+		"count":                "数量",
+		"device":               "动作执行后的设备状态",
+		"mgs":                  "设备的MG",
+		"pes":                  "MG的PE",
+		"id":                   "编号",
+		"weight":               "权重",
+		"total":                "数量",
+		"migrate_in":           "上电以来累计迁入数量",
+		"migrate_out":          "上电以来累计迁出数量",
+		"labels":               "拓扑中的标签",
+		"stat":                 "相对按权重比例目标的分布",
+		"average_bias":         "平均偏差（个）",
+		"average_bias_percent": "平均偏差百分比（%）",
+		"max_bias":             "最大偏差（个）",
+		"max_bias_percent":     "最大偏差百分比（%）",
+		"branch":               "动作所在分支的备选方案",
+		"branches":             "每个分支各备选方案的对比",
+		"alts":                 "分支的备选方案",
+		"mg_max_bias_percent":  "备选方案执行后MG的最大偏差百分比（%）",
+		"pe_max_bias_percent":  "备选方案执行后PE的最大偏差百分比（%）",
+		"errors":               "执行失败的动作及其错误",
+		"error":                "动作返回的错误",
+		"preview":              "动作仅为预览, 下一个动作从它之前的设备开始",
+		"timing":               "迁移模型下该动作迁移的模拟耗时",
+		"seconds":              "模拟秒数",
+		"moves":                "迁移的键数",
+		"bytes":                "迁移的字节数",
+		"busiest_mg_id":        "忙碌最久的PE所在MG",
+		"busiest_pe_id":        "忙碌最久的PE",
+		"busiest_seconds":      "最繁忙PE有迁移进行的秒数",
+		"busiest_moves":        "最繁忙PE参与的迁移数",
+		"progress":             "随时间迁移的键数",
+		"moved":                "到该时刻已迁移的键数",
+		"percent":              "到该时刻已迁移的键百分比",
+	},
+}
+
+func SetLang(lang string) bool {
+	if _, ok := catalog[lang]; !ok {
+		return false
+	}
+	currentLang = lang
+	return true
+}
+
+func Langs() []string {
+	langs := make([]string, 0, len(catalog))
+	for k, _ := range catalog {
+		langs = append(langs, k)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+func Msg(key string) string {
+	if msg, ok := catalog[currentLang][key]; ok {
+		return msg
+	}
+	return catalog[LangEn][key]
+}
+
+func FieldDescriptions() map[string]string {
+	return fieldCatalog[currentLang]
+}
@@ -0,0 +1,161 @@
+package sim
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// LineEditor reads lines from a terminal with history on the up and down
+// keys and completion on tab. When the input is not a terminal it reads
+// plain lines.
+type LineEditor struct {
+	in       *bufio.Reader
+	out      io.Writer
+	fd       int
+	raw      bool
+	history  []string
+	complete func(line string) []string
+}
+
+// NewLineEditor reads from in and echoes to out. complete returns the
+// lines the line typed so far can be completed to, it may be nil.
+func NewLineEditor(in *os.File, out io.Writer, complete func(line string) []string) *LineEditor {
+	editor := &LineEditor{in: bufio.NewReader(in), out: out, fd: int(in.Fd()), complete: complete}
+	if restore, err := makeRaw(editor.fd); err == nil {
+		restore()
+		editor.raw = true
+	}
+	return editor
+}
+
+// AddHistory appends line to the lines the up key brings back.
+func (self *LineEditor) AddHistory(line string) {
+	if len(line) == 0 || (len(self.history) > 0 && self.history[len(self.history)-1] == line) {
+		return
+	}
+	self.history = append(self.history, line)
+}
+
+// ReadLine shows prompt and returns the line without the newline. It
+// returns io.EOF at the end of the input or on ctrl-d at an empty line.
+func (self *LineEditor) ReadLine(prompt string) (string, error) {
+	io.WriteString(self.out, prompt)
+	if !self.raw {
+		line, err := self.in.ReadString('\n')
+		if err != nil && len(line) == 0 {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	restore, err := makeRaw(self.fd)
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+
+	buf := []rune{}
+	index := len(self.history)
+	redraw := func() {
+		fmt.Fprintf(self.out, "\r\033[K%s%s", prompt, string(buf))
+	}
+
+	for {
+		r, _, err := self.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch r {
+		case '\r', '\n':
+			io.WriteString(self.out, "\r\n")
+			return string(buf), nil
+		case 3: // ctrl-c
+			io.WriteString(self.out, "^C\r\n")
+			return "", nil
+		case 4: // ctrl-d
+			if len(buf) == 0 {
+				io.WriteString(self.out, "\r\n")
+				return "", io.EOF
+			}
+		case 21: // ctrl-u
+			buf = buf[:0]
+			redraw()
+		case 127, 8:
+			if len(buf) > 0 {
+				buf = buf[:len(buf)-1]
+				redraw()
+			}
+		case '\t':
+			buf = self.completeLine(buf)
+			redraw()
+		case 27:
+			if next, _, _ := self.in.ReadRune(); next != '[' {
+				continue
+			}
+			// A CSI sequence ends with a byte in 0x40-0x7e, e.g. the ~ of
+			// ESC [ 3 ~ for Delete; only the arrows without parameters are
+			// handled.
+			key, _, err := self.in.ReadRune()
+			params := false
+			for err == nil && (key < 0x40 || key > 0x7e) {
+				params = true
+				key, _, err = self.in.ReadRune()
+			}
+			if params {
+				key = 0
+			}
+			switch {
+			case key == 'A' && index > 0:
+				index--
+				buf = []rune(self.history[index])
+			case key == 'B' && index < len(self.history):
+				index++
+				buf = buf[:0]
+				if index < len(self.history) {
+					buf = []rune(self.history[index])
+				}
+			}
+			redraw()
+		default:
+			if r >= ' ' {
+				buf = append(buf, r)
+				io.WriteString(self.out, string(r))
+			}
+		}
+	}
+}
+
+// completeLine extends buf to the common prefix of its completions and
+// lists them if there is more than one.
+func (self *LineEditor) completeLine(buf []rune) []rune {
+	if self.complete == nil {
+		return buf
+	}
+	candidates := self.complete(string(buf))
+	if len(candidates) == 0 {
+		return buf
+	}
+
+	prefix := candidates[0]
+	for _, v := range candidates[1:] {
+		for !strings.HasPrefix(v, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+
+	if len(candidates) > 1 && len(prefix) <= len(string(buf)) {
+		head := strings.LastIndexAny(string(buf), " ,:") + 1
+		io.WriteString(self.out, "\r\n")
+		for _, v := range candidates {
+			fmt.Fprintf(self.out, "%s\r\n", strings.TrimSpace(v[head:]))
+		}
+	}
+	if len(prefix) > len(string(buf)) {
+		return []rune(prefix)
+	}
+	return buf
+}
@@ -0,0 +1,244 @@
+// Package sim runs scenarios of actions on a straw2 device and reports how
+// keys are distributed and migrated. Scenarios are read from cfg, yaml or
+// json files, see ParseFile, and run by ActionList.Run.
+package sim
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type RunConfig struct {
+	cfgFileName         string
+	outputFileName      string
+	format              string
+	verbosity           string
+	stdout              bool
+	lang                string
+	dryExpand           bool
+	sweepFileName       string
+	sweepOutputFileName string
+	listActions         bool
+	loadStateFileName   string
+	onError             string
+	verify              bool
+	dryRun              bool
+	interactive         bool
+	actionsSet          bool
+}
+
+func (self *RunConfig) Parse(args []string) {
+	flags := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ExitOnError)
+	flags.StringVar(&self.cfgFileName, "actions", "actions.cfg", "actions file name")
+	flags.StringVar(&self.outputFileName, "output", "result.txt", "output file name")
+	flags.StringVar(&self.format, "format", "text", "output format: text|json|csv|html|all")
+	flags.StringVar(&self.verbosity, "verbosity", "counts", "text report verbosity: summary|counts|weights|data")
+	flags.BoolVar(&self.stdout, "stdout", true, "write text report to stdout")
+	flags.StringVar(&self.lang, "lang", LangEn, "report language: "+strings.Join(Langs(), "|"))
+	flags.BoolVar(&self.dryExpand, "dry-expand", false, "print the expanded action list and exit")
+	flags.StringVar(&self.sweepFileName, "sweep", "", "sweep file name, run actions for every combination of power_on parameters")
+	flags.StringVar(&self.sweepOutputFileName, "sweep_output", "sweep.txt", "sweep output file name")
+	flags.BoolVar(&self.listActions, "list-actions", false, "print the registered actions and their parameters and exit")
+	flags.StringVar(&self.loadStateFileName, "load-state", "", "state file written by save, loaded before the first action")
+	flags.StringVar(&self.onError, "on-error", "stop", "what to do when an action fails: stop|continue")
+	flags.BoolVar(&self.verify, "verify", false, "verify the device invariants after every action")
+	flags.BoolVar(&self.dryRun, "dry-run", false, "preview every action: report its moves and balance, then discard the new device")
+	flags.BoolVar(&self.interactive, "interactive", false, "read actions and commands from a prompt, after running -actions if given")
+
+	flags.Parse(args)
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "actions" {
+			self.actionsSet = true
+		}
+	})
+}
+
+func (self *RunConfig) Check() bool {
+	switch self.format {
+	case "text", "json", "csv", "html", "all":
+	default:
+		fmt.Printf("ERROR: unknown output format \"%s\"\n", self.format)
+		return false
+	}
+
+	if !SetLang(self.lang) {
+		fmt.Printf("ERROR: unknown language \"%s\"\n", self.lang)
+		return false
+	}
+
+	if _, ok := ParseVerbosity(self.verbosity); !ok {
+		fmt.Printf("ERROR: unknown verbosity \"%s\"\n", self.verbosity)
+		return false
+	}
+
+	if _, ok := ParsePolicy(self.onError); !ok {
+		fmt.Printf("ERROR: unknown error policy \"%s\"\n", self.onError)
+		return false
+	}
+
+	var err error
+	if !self.interactive || self.actionsSet {
+		_, err = os.Stat(self.cfgFileName)
+		if os.IsNotExist(err) {
+			fmt.Printf("ERROR: file \"%s\" is not exist", self.cfgFileName)
+			return false
+		}
+	}
+
+	if len(self.loadStateFileName) > 0 {
+		_, err = os.Stat(self.loadStateFileName)
+		if os.IsNotExist(err) {
+			fmt.Printf("ERROR: file \"%s\" is not exist", self.loadStateFileName)
+			return false
+		}
+	}
+
+	if len(self.sweepFileName) > 0 {
+		_, err = os.Stat(self.sweepFileName)
+		if os.IsNotExist(err) {
+			fmt.Printf("ERROR: file \"%s\" is not exist", self.sweepFileName)
+			return false
+		}
+	}
+	return true
+}
+
+func OutputToFile(filename string, str string) {
+	if err := WriteFile(filename, str); err != nil {
+		fmt.Printf("ERROR: cannot open file %s to write\n", filename)
+	}
+}
+
+// WriteFile writes str to filename, replacing what was there.
+func WriteFile(filename string, str string) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteString(str)
+	return err
+}
+
+// Main runs the simulator with the command line arguments args, without the
+// program name, and returns the exit code.
+func Main(args []string) int {
+	if len(args) > 0 && args[0] == "convert" {
+		if !RunConvert(args[1:]) {
+			return 1
+		}
+		return 0
+	}
+	if len(args) > 0 && args[0] == "serve" {
+		if !RunServe(args[1:]) {
+			return 1
+		}
+		return 0
+	}
+
+	runConfig := &RunConfig{}
+	runConfig.Parse(args)
+	if runConfig.listActions {
+		PrintActions(os.Stdout)
+		return 0
+	}
+
+	if !runConfig.Check() {
+		return 1
+	}
+
+	actions := NewActionList()
+	if !runConfig.interactive || runConfig.actionsSet {
+		actions = ParseFile(runConfig.cfgFileName)
+		if actions == nil {
+			fmt.Printf("ERROR: parse file %s failed\n", runConfig.cfgFileName)
+			return 1
+		}
+	}
+	policy, _ := ParsePolicy(runConfig.onError)
+	actions.SetPolicy(policy)
+	actions.SetVerify(runConfig.verify)
+	actions.SetDryRun(runConfig.dryRun)
+
+	if len(runConfig.loadStateFileName) > 0 {
+		device, err := LoadStateFile(runConfig.loadStateFileName)
+		if err != nil {
+			fmt.Printf("ERROR: cannot load state: %v\n", err)
+			return 1
+		}
+		actions.actions = append([]Action{&ActionLoad{file: runConfig.loadStateFileName, device: device}}, actions.actions...)
+	}
+
+	verbosity, _ := ParseVerbosity(runConfig.verbosity)
+	if runConfig.interactive {
+		repl := NewRepl(os.Stdout, verbosity)
+		repl.SetPolicy(policy)
+		repl.SetVerify(runConfig.verify)
+		repl.SetDryRun(runConfig.dryRun)
+		RunInteractive(repl, actions)
+		return 0
+	}
+
+	if runConfig.dryExpand {
+		actions.Expand(os.Stdout)
+		return 0
+	}
+
+	if len(runConfig.sweepFileName) > 0 {
+		sweep := ParseSweepFile(runConfig.sweepFileName)
+		if sweep == nil {
+			fmt.Printf("ERROR: parse file %s failed\n", runConfig.sweepFileName)
+			return 1
+		}
+
+		if errors := sweep.Check(actions); len(errors) > 0 {
+			for _, err := range errors {
+				fmt.Printf("ERROR: %v\n", err)
+			}
+			return 1
+		}
+
+		str, err := sweep.Run(actions)
+		fmt.Printf("%s", str)
+		OutputToFile(runConfig.sweepOutputFileName, str)
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	renderer := NewRenderer(verbosity)
+	if runConfig.stdout {
+		renderer.AddSink(os.Stdout)
+	}
+	if runConfig.format == "text" || runConfig.format == "all" {
+		renderer.AddFileSink(runConfig.outputFileName)
+	}
+
+	actions.Run(renderer)
+	renderer.Close()
+
+	report := NewRunReport(runConfig.cfgFileName, actions)
+	if runConfig.format == "json" || runConfig.format == "all" {
+		OutputToFile(ReplaceExt(runConfig.outputFileName, ".json"), report.Json())
+	}
+	if runConfig.format == "csv" || runConfig.format == "all" {
+		OutputToFile(ReplaceExt(runConfig.outputFileName, ".csv"), report.Csv())
+	}
+	if runConfig.format == "html" || runConfig.format == "all" {
+		OutputToFile(ReplaceExt(runConfig.outputFileName, ".html"), report.Html())
+	}
+
+	if len(actions.failures) > 0 {
+		for _, v := range actions.failures {
+			fmt.Printf("ERROR: %s\n", v)
+		}
+		fmt.Printf("ERROR: %d failure(s)\n", len(actions.failures))
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,1136 @@
+package sim
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type TokenKind int
+
+const (
+	TokenEOF TokenKind = iota
+	TokenNewline
+	TokenIdent
+	TokenNumber
+	TokenColon
+	TokenEqual
+	TokenComma
+	TokenVar
+	TokenPlus
+	TokenMinus
+	TokenStar
+	TokenSlash
+	TokenPercent
+	TokenLParen
+	TokenRParen
+	TokenLBrace
+	TokenRBrace
+	TokenDotDot
+	TokenLess
+	TokenLessEqual
+	TokenGreater
+	TokenGreaterEqual
+	TokenEqualEqual
+	TokenNotEqual
+	TokenLBracket
+	TokenRBracket
+	TokenDot
+	TokenString
+	TokenError
+)
+
+var tokenKindNames = []string{"end of file", "end of line", "name", "number", "':'", "'='", "','", "variable",
+	"'+'", "'-'", "'*'", "'/'", "'%'", "'('", "')'", "'{'", "'}'", "'..'",
+	"'<'", "'<='", "'>'", "'>='", "'=='", "'!='", "'['", "']'", "'.'", "string", "invalid character"}
+
+func (self TokenKind) String() string {
+	return tokenKindNames[self]
+}
+
+type Token struct {
+	kind   TokenKind
+	text   string
+	line   int
+	column int
+}
+
+func (self *Token) String() string {
+	switch self.kind {
+	case TokenIdent, TokenNumber, TokenVar, TokenString, TokenError:
+		return fmt.Sprintf("%s \"%s\"", self.kind, self.text)
+	}
+	return self.kind.String()
+}
+
+type Lexer struct {
+	src    []rune
+	pos    int
+	line   int
+	column int
+}
+
+func NewLexer(src string) *Lexer {
+	return &Lexer{src: []rune(src), line: 1, column: 1}
+}
+
+func (self *Lexer) peek() rune {
+	if self.pos >= len(self.src) {
+		return 0
+	}
+	return self.src[self.pos]
+}
+
+func (self *Lexer) advance() rune {
+	ch := self.src[self.pos]
+	self.pos++
+	if ch == '\n' {
+		self.line++
+		self.column = 1
+	} else {
+		self.column++
+	}
+	return ch
+}
+
+func isIdentStart(ch rune) bool {
+	return ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+func isDigit(ch rune) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+func (self *Lexer) RestOfLine() string {
+	begin := self.pos
+	for self.pos < len(self.src) && self.peek() != '\n' {
+		self.advance()
+	}
+	line := string(self.src[begin:self.pos])
+	if comment := strings.Index(line, "#"); comment >= 0 {
+		line = line[:comment]
+	}
+	return strings.TrimSpace(line)
+}
+
+func (self *Lexer) Next() *Token {
+	for self.pos < len(self.src) {
+		ch := self.peek()
+		if ch == '#' {
+			for self.pos < len(self.src) && self.peek() != '\n' {
+				self.advance()
+			}
+			continue
+		}
+		if ch != ' ' && ch != '\t' && ch != '\r' {
+			break
+		}
+		self.advance()
+	}
+
+	tok := &Token{line: self.line, column: self.column}
+	if self.pos >= len(self.src) {
+		tok.kind = TokenEOF
+		return tok
+	}
+
+	begin := self.pos
+	ch := self.advance()
+	switch {
+	case ch == '\n':
+		tok.kind = TokenNewline
+	case ch == ':':
+		tok.kind = TokenColon
+	case ch == '=' && self.peek() == '=':
+		self.advance()
+		tok.kind = TokenEqualEqual
+	case ch == '=':
+		tok.kind = TokenEqual
+	case ch == '!' && self.peek() == '=':
+		self.advance()
+		tok.kind = TokenNotEqual
+	case ch == '<' && self.peek() == '=':
+		self.advance()
+		tok.kind = TokenLessEqual
+	case ch == '<':
+		tok.kind = TokenLess
+	case ch == '>' && self.peek() == '=':
+		self.advance()
+		tok.kind = TokenGreaterEqual
+	case ch == '>':
+		tok.kind = TokenGreater
+	case ch == '[':
+		tok.kind = TokenLBracket
+	case ch == ']':
+		tok.kind = TokenRBracket
+	case ch == ',':
+		tok.kind = TokenComma
+	case ch == '+':
+		tok.kind = TokenPlus
+	case ch == '-':
+		tok.kind = TokenMinus
+	case ch == '*':
+		tok.kind = TokenStar
+	case ch == '/':
+		tok.kind = TokenSlash
+	case ch == '%':
+		tok.kind = TokenPercent
+	case ch == '(':
+		tok.kind = TokenLParen
+	case ch == ')':
+		tok.kind = TokenRParen
+	case ch == '{':
+		tok.kind = TokenLBrace
+	case ch == '}':
+		tok.kind = TokenRBrace
+	case ch == '.' && self.peek() == '.':
+		self.advance()
+		tok.kind = TokenDotDot
+	case ch == '.':
+		tok.kind = TokenDot
+	case ch == '$' && isIdentStart(self.peek()):
+		for isIdentStart(self.peek()) || isDigit(self.peek()) {
+			self.advance()
+		}
+		tok.kind = TokenVar
+	case isIdentStart(ch):
+		for isIdentStart(self.peek()) || isDigit(self.peek()) {
+			self.advance()
+		}
+		tok.kind = TokenIdent
+	case isDigit(ch):
+		for isDigit(self.peek()) {
+			self.advance()
+		}
+		if self.peek() == '.' && self.pos+1 < len(self.src) && isDigit(self.src[self.pos+1]) {
+			self.advance()
+			for isDigit(self.peek()) {
+				self.advance()
+			}
+		}
+		tok.kind = TokenNumber
+	case ch == '"':
+		for self.pos < len(self.src) && self.peek() != '"' && self.peek() != '\n' {
+			self.advance()
+		}
+		if self.peek() != '"' {
+			tok.kind = TokenError
+			tok.text = "unterminated string"
+			return tok
+		}
+		self.advance()
+		tok.kind = TokenString
+		tok.text = string(self.src[begin+1 : self.pos-1])
+		return tok
+	default:
+		tok.kind = TokenError
+	}
+
+	tok.text = string(self.src[begin:self.pos])
+	if tok.kind == TokenIdent || tok.kind == TokenVar {
+		tok.text = strings.ToLower(tok.text)
+	}
+	if tok.kind == TokenVar {
+		tok.text = tok.text[1:]
+	}
+	return tok
+}
+
+type ParseError struct {
+	filename string
+	line     int
+	column   int
+	msg      string
+}
+
+func (self *ParseError) Error() string {
+	if self.line == 0 {
+		return fmt.Sprintf("%s: %s", self.filename, self.msg)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", self.filename, self.line, self.column, self.msg)
+}
+
+type Param struct {
+	name   string
+	kind   TokenKind
+	value  uint32
+	str    string
+	line   int
+	column int
+}
+
+type ActionStmt struct {
+	name   string
+	line   int
+	column int
+	params []*Param
+}
+
+const maxLoopIterations = 1000000
+
+type ParseContext struct {
+	vars        map[string]int64
+	topologies  map[string]*Topology
+	checkpoints map[string]bool
+	includes    []string
+	actions     *ActionList
+	errors      []*ParseError
+	// noFiles makes include, topology files and the actions that read or
+	// write files errors, for input from clients of serve.
+	noFiles  bool
+	warnings []string
+	// nodes are the positions of the nodes of a YAML scenario document.
+	nodes map[string]yamlPos
+}
+
+func NewParseContext() *ParseContext {
+	return &ParseContext{vars: make(map[string]int64), topologies: make(map[string]*Topology),
+		checkpoints: make(map[string]bool), actions: NewActionList()}
+}
+
+type Parser struct {
+	filename string
+	lexer    *Lexer
+	tok      *Token
+	ctx      *ParseContext
+	// node is the path of the scenario document node being loaded, such
+	// as "actions[2]". It names errors without a line.
+	node string
+}
+
+func NewParser(filename, src string, ctx *ParseContext) *Parser {
+	parser := &Parser{filename: filename, lexer: NewLexer(src), ctx: ctx}
+	parser.next()
+	return parser
+}
+
+func (self *Parser) next() {
+	self.tok = self.lexer.Next()
+}
+
+func (self *Parser) errorAt(line, column int, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if line == 0 && len(self.node) > 0 {
+		msg = self.node + ": " + msg
+	}
+	self.ctx.errors = append(self.ctx.errors, &ParseError{filename: self.filename, line: line, column: column, msg: msg})
+}
+
+func (self *Parser) expect(kind TokenKind) (*Token, bool) {
+	tok := self.tok
+	if tok.kind != kind {
+		self.errorAt(tok.line, tok.column, "expected %s, found %s", kind, tok)
+		return tok, false
+	}
+	self.next()
+	return tok, true
+}
+
+func (self *Parser) skipLine() {
+	for !self.endOfStmt() {
+		self.next()
+	}
+}
+
+func (self *Parser) endOfStmt() bool {
+	return self.tok.kind == TokenNewline || self.tok.kind == TokenEOF || self.tok.kind == TokenRBrace
+}
+
+func (self *Parser) parseFactor() (int64, bool) {
+	tok := self.tok
+	switch tok.kind {
+	case TokenNumber:
+		self.next()
+		if strings.Contains(tok.text, ".") {
+			self.errorAt(tok.line, tok.column, "expected integer, found %s", tok)
+			return 0, false
+		}
+		val, err := strconv.ParseInt(tok.text, 10, 64)
+		if err != nil || val > math.MaxUint32 {
+			self.errorAt(tok.line, tok.column, "number %s is out of range", tok.text)
+			return 0, false
+		}
+		return val, true
+	case TokenVar:
+		self.next()
+		val, ok := self.ctx.vars[tok.text]
+		if !ok {
+			self.errorAt(tok.line, tok.column, "undefined variable \"$%s\"", tok.text)
+			return 0, false
+		}
+		return val, true
+	case TokenMinus:
+		self.next()
+		val, ok := self.parseFactor()
+		return -val, ok
+	case TokenLParen:
+		self.next()
+		val, ok := self.parseExpr()
+		if !ok {
+			return 0, false
+		}
+		if _, ok = self.expect(TokenRParen); !ok {
+			return 0, false
+		}
+		return val, true
+	}
+
+	self.errorAt(tok.line, tok.column, "expected value, found %s", tok)
+	return 0, false
+}
+
+func (self *Parser) parseTerm() (int64, bool) {
+	val, ok := self.parseFactor()
+	for ok && (self.tok.kind == TokenStar || self.tok.kind == TokenSlash || self.tok.kind == TokenPercent) {
+		op := self.tok
+		self.next()
+
+		var right int64
+		right, ok = self.parseFactor()
+		if !ok {
+			break
+		}
+
+		switch op.kind {
+		case TokenStar:
+			// Both are within ±MaxUint32, but their product may not fit
+			// in an int64.
+			if right != 0 && abs64(val) > math.MaxUint32/abs64(right) {
+				self.errorAt(op.line, op.column, "value is out of range")
+				return 0, false
+			}
+			val *= right
+		case TokenSlash, TokenPercent:
+			if right == 0 {
+				self.errorAt(op.line, op.column, "division by zero")
+				return 0, false
+			}
+			if op.kind == TokenSlash {
+				val /= right
+			} else {
+				val %= right
+			}
+		}
+
+		if val > math.MaxUint32 || val < -math.MaxUint32 {
+			self.errorAt(op.line, op.column, "value is out of range")
+			return 0, false
+		}
+	}
+	return val, ok
+}
+
+func (self *Parser) parseExpr() (int64, bool) {
+	val, ok := self.parseTerm()
+	for ok && (self.tok.kind == TokenPlus || self.tok.kind == TokenMinus) {
+		op := self.tok
+		self.next()
+
+		var right int64
+		right, ok = self.parseTerm()
+		if !ok {
+			break
+		}
+
+		if op.kind == TokenPlus {
+			val += right
+		} else {
+			val -= right
+		}
+		if val > math.MaxUint32 || val < -math.MaxUint32 {
+			self.errorAt(op.line, op.column, "value is out of range")
+			return 0, false
+		}
+	}
+	return val, ok
+}
+
+func abs64(val int64) int64 {
+	if val < 0 {
+		return -val
+	}
+	return val
+}
+
+func (self *Parser) parseUint32(name *Token) (uint32, bool) {
+	begin := self.tok
+	val, ok := self.parseExpr()
+	if !ok {
+		return 0, false
+	}
+
+	if val < 0 || val > math.MaxUint32 {
+		self.errorAt(begin.line, begin.column, "value %d of \"%s\" is out of range", val, name.text)
+		return 0, false
+	}
+	return uint32(val), true
+}
+
+func (self *Parser) parseParam() (*Param, bool) {
+	name, ok := self.expect(TokenIdent)
+	if !ok {
+		return nil, false
+	}
+
+	if _, ok = self.expect(TokenEqual); !ok {
+		return nil, false
+	}
+
+	if self.tok.kind == TokenString || self.tok.kind == TokenIdent {
+		tok := self.tok
+		self.next()
+		return &Param{name: name.text, kind: tok.kind, str: tok.text, line: name.line, column: name.column}, true
+	}
+
+	val, ok := self.parseUint32(name)
+	if !ok {
+		return nil, false
+	}
+
+	return &Param{name: name.text, kind: TokenNumber, value: val, line: name.line, column: name.column}, true
+}
+
+func (self *Parser) parseLet() bool {
+	name, ok := self.expect(TokenIdent)
+	if !ok {
+		return false
+	}
+
+	if _, ok = self.expect(TokenEqual); !ok {
+		return false
+	}
+
+	val, ok := self.parseUint32(name)
+	if !ok {
+		return false
+	}
+
+	if !self.endOfStmt() {
+		self.errorAt(self.tok.line, self.tok.column, "expected %s, found %s", TokenNewline, self.tok)
+		return false
+	}
+
+	self.ctx.vars[name.text] = int64(val)
+	return true
+}
+
+func (self *Parser) parseInclude(name *Token) bool {
+	if self.tok.kind != TokenColon {
+		self.errorAt(self.tok.line, self.tok.column, "expected %s, found %s", TokenColon, self.tok)
+		return false
+	}
+
+	line, column := self.lexer.line, self.lexer.column
+	filename := strings.Trim(self.lexer.RestOfLine(), "\"'")
+	self.next()
+
+	if len(filename) == 0 {
+		self.errorAt(line, column, "missing file name for include")
+		return false
+	}
+	if self.ctx.noFiles {
+		self.errorAt(name.line, name.column, "include is not allowed here")
+		return false
+	}
+
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(filepath.Dir(self.filename), filename)
+	}
+
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		abs = filename
+	}
+
+	for _, v := range self.ctx.includes {
+		if v == abs {
+			self.errorAt(name.line, name.column, "recursive include of \"%s\"", filename)
+			return false
+		}
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		self.errorAt(line, column, "cannot open include file \"%s\"", filename)
+		return false
+	}
+
+	self.ctx.includes = append(self.ctx.includes, abs)
+	NewParser(filename, string(data), self.ctx).parseAll()
+	self.ctx.includes = self.ctx.includes[:len(self.ctx.includes)-1]
+	return true
+}
+
+func (self *Parser) parseLoop(keyword *Token, var_name string, values []int64) bool {
+	if _, ok := self.expect(TokenLBrace); !ok {
+		return false
+	}
+
+	if len(values) > maxLoopIterations {
+		self.errorAt(keyword.line, keyword.column, "loop has %d iterations, more than %d", len(values), maxLoopIterations)
+		return false
+	}
+
+	old_val, has_old := self.ctx.vars[var_name]
+	body_lexer := *self.lexer
+	body_tok := self.tok
+
+	actions := self.ctx.actions
+	if len(values) == 0 {
+		self.ctx.actions = NewActionList()
+		values = []int64{0}
+	}
+
+	ok := true
+	for i, v := range values {
+		if i > 0 {
+			lexer := body_lexer
+			self.lexer = &lexer
+			self.tok = body_tok
+		}
+
+		if len(var_name) > 0 {
+			self.ctx.vars[var_name] = v
+		}
+
+		errors := len(self.ctx.errors)
+		if !self.parseBlock(keyword) {
+			ok = false
+			break
+		}
+		if len(self.ctx.errors) > errors {
+			break
+		}
+	}
+
+	self.ctx.actions = actions
+	if len(var_name) > 0 {
+		if has_old {
+			self.ctx.vars[var_name] = old_val
+		} else {
+			delete(self.ctx.vars, var_name)
+		}
+	}
+	return ok
+}
+
+func (self *Parser) parseBlock(keyword *Token) bool {
+	for {
+		switch self.tok.kind {
+		case TokenEOF:
+			self.errorAt(keyword.line, keyword.column, "missing %s for \"%s\"", TokenRBrace, keyword.text)
+			return false
+		case TokenRBrace:
+			self.next()
+			return true
+		case TokenNewline:
+			self.next()
+			continue
+		}
+		self.parseOne()
+	}
+}
+
+func (self *Parser) parseFor(keyword *Token) bool {
+	name, _ := self.expect(TokenIdent)
+
+	if in, ok := self.expect(TokenIdent); !ok || in.text != "in" {
+		if ok {
+			self.errorAt(in.line, in.column, "expected \"in\", found %s", in)
+		}
+		return false
+	}
+
+	begin, ok := self.parseExpr()
+	if !ok {
+		return false
+	}
+
+	if _, ok = self.expect(TokenDotDot); !ok {
+		return false
+	}
+
+	end, ok := self.parseExpr()
+	if !ok {
+		return false
+	}
+
+	step := int64(1)
+	if self.tok.kind == TokenIdent && self.tok.text == "step" {
+		step_tok := self.tok
+		self.next()
+
+		step, ok = self.parseExpr()
+		if !ok {
+			return false
+		}
+		if step <= 0 {
+			self.errorAt(step_tok.line, step_tok.column, "step must be greater than 0")
+			return false
+		}
+	}
+
+	values := make([]int64, 0)
+	for v := begin; v <= end && len(values) <= maxLoopIterations; v += step {
+		values = append(values, v)
+	}
+
+	return self.parseLoop(keyword, name.text, values)
+}
+
+func (self *Parser) parseRepeat(keyword *Token) bool {
+	begin := self.tok
+	count, ok := self.parseExpr()
+	if !ok {
+		return false
+	}
+
+	if count < 0 || count > maxLoopIterations {
+		self.errorAt(begin.line, begin.column, "repeat count %d is out of range", count)
+		return false
+	}
+
+	return self.parseLoop(keyword, "", make([]int64, count))
+}
+
+func (self *Parser) parseId(what string) (uint32, bool) {
+	if _, ok := self.expect(TokenLBracket); !ok {
+		return 0, false
+	}
+
+	id, ok := self.parseUint32(&Token{kind: TokenIdent, text: what})
+	if !ok {
+		return 0, false
+	}
+
+	_, ok = self.expect(TokenRBracket)
+	return id, ok
+}
+
+func (self *Parser) parseMetric() (ExprNode, bool) {
+	name, _ := self.expect(TokenIdent)
+	metric := &ExprMetric{name: name.text}
+	metrics := deviceMetrics
+
+	if name.text == "mg" {
+		id, ok := self.parseId("mg")
+		if !ok {
+			return nil, false
+		}
+		metric.mg_id = id
+		metric.has_mg = true
+		metrics = mgMetrics
+
+		if _, ok = self.expect(TokenDot); !ok {
+			return nil, false
+		}
+
+		if name, ok = self.expect(TokenIdent); !ok {
+			return nil, false
+		}
+		metric.name = name.text
+
+		if name.text == "pe" {
+			if id, ok = self.parseId("pe"); !ok {
+				return nil, false
+			}
+			metric.pe_id = id
+			metric.has_pe = true
+			metrics = peMetrics
+
+			if _, ok = self.expect(TokenDot); !ok {
+				return nil, false
+			}
+
+			if name, ok = self.expect(TokenIdent); !ok {
+				return nil, false
+			}
+			metric.name = name.text
+		}
+	}
+
+	if !findMetric(metrics, metric.name) {
+		self.errorAt(name.line, name.column, "unknown metric \"%s\"", metric.name)
+		return nil, false
+	}
+	return metric, true
+}
+
+func (self *Parser) parseValueFactor() (ExprNode, bool) {
+	tok := self.tok
+	switch tok.kind {
+	case TokenNumber:
+		self.next()
+		val, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			self.errorAt(tok.line, tok.column, "invalid number %s", tok.text)
+			return nil, false
+		}
+		return &ExprNumber{val: val}, true
+	case TokenVar:
+		self.next()
+		val, ok := self.ctx.vars[tok.text]
+		if !ok {
+			self.errorAt(tok.line, tok.column, "undefined variable \"$%s\"", tok.text)
+			return nil, false
+		}
+		return &ExprNumber{val: float64(val)}, true
+	case TokenIdent:
+		return self.parseMetric()
+	case TokenMinus:
+		self.next()
+		node, ok := self.parseValueFactor()
+		if !ok {
+			return nil, false
+		}
+		return &ExprBinary{op: TokenMinus, left: &ExprNumber{val: 0}, right: node}, true
+	case TokenLParen:
+		self.next()
+		node, ok := self.parseValueExpr()
+		if !ok {
+			return nil, false
+		}
+		_, ok = self.expect(TokenRParen)
+		return node, ok
+	}
+
+	self.errorAt(tok.line, tok.column, "expected value, found %s", tok)
+	return nil, false
+}
+
+func (self *Parser) parseValueTerm() (ExprNode, bool) {
+	node, ok := self.parseValueFactor()
+	for ok && (self.tok.kind == TokenStar || self.tok.kind == TokenSlash) {
+		op := self.tok.kind
+		self.next()
+
+		var right ExprNode
+		if right, ok = self.parseValueFactor(); ok {
+			node = &ExprBinary{op: op, left: node, right: right}
+		}
+	}
+	return node, ok
+}
+
+func (self *Parser) parseValueExpr() (ExprNode, bool) {
+	node, ok := self.parseValueTerm()
+	for ok && (self.tok.kind == TokenPlus || self.tok.kind == TokenMinus) {
+		op := self.tok.kind
+		self.next()
+
+		var right ExprNode
+		if right, ok = self.parseValueTerm(); ok {
+			node = &ExprBinary{op: op, left: node, right: right}
+		}
+	}
+	return node, ok
+}
+
+func (self *Parser) parseExpect(name *Token) bool {
+	if _, ok := self.expect(TokenColon); !ok {
+		return false
+	}
+
+	left, ok := self.parseValueExpr()
+	if !ok {
+		return false
+	}
+
+	op := self.tok
+	switch op.kind {
+	case TokenLess, TokenLessEqual, TokenGreater, TokenGreaterEqual, TokenEqualEqual, TokenNotEqual:
+		self.next()
+	default:
+		self.errorAt(op.line, op.column, "expected comparison, found %s", op)
+		return false
+	}
+
+	right, ok := self.parseValueExpr()
+	if !ok {
+		return false
+	}
+
+	if !self.endOfStmt() {
+		self.errorAt(self.tok.line, self.tok.column, "expected %s, found %s", TokenNewline, self.tok)
+		return false
+	}
+
+	self.ctx.actions.Add(&ActionExpect{
+		cond:     &ExpectCond{op: op.kind, left: left, right: right},
+		filename: self.filename,
+		line:     name.line,
+		column:   name.column,
+	})
+	return true
+}
+
+func (self *Parser) parseStmt() (*ActionStmt, bool) {
+	name, ok := self.expect(TokenIdent)
+	if !ok {
+		return nil, false
+	}
+
+	if name.text == "let" && self.tok.kind == TokenIdent {
+		return nil, self.parseLet()
+	}
+
+	if name.text == "include" {
+		return nil, self.parseInclude(name)
+	}
+
+	if name.text == "for" && self.tok.kind == TokenIdent {
+		return nil, self.parseFor(name)
+	}
+
+	if name.text == "repeat" && self.tok.kind != TokenColon {
+		return nil, self.parseRepeat(name)
+	}
+
+	if name.text == "expect" {
+		return nil, self.parseExpect(name)
+	}
+
+	if name.text == "topology" && self.tok.kind == TokenIdent {
+		return nil, self.parseTopology(name)
+	}
+
+	if name.text == "branch" && self.tok.kind == TokenLBrace {
+		return nil, self.parseBranch(name)
+	}
+
+	if name.text == "preview" && self.tok.kind == TokenColon {
+		return nil, self.parsePreview(name)
+	}
+
+	if _, ok = self.expect(TokenColon); !ok {
+		return nil, false
+	}
+
+	stmt := &ActionStmt{name: name.text, line: name.line, column: name.column}
+	for !self.endOfStmt() {
+		param, ok := self.parseParam()
+		if !ok {
+			return nil, false
+		}
+		stmt.params = append(stmt.params, param)
+
+		if self.endOfStmt() {
+			break
+		}
+		if _, ok = self.expect(TokenComma); !ok {
+			return nil, false
+		}
+	}
+
+	return stmt, true
+}
+
+// collectParams checks the kind of every parameter against specs and
+// resolves topology references.
+func (self *Parser) collectParams(specs []*ParamSpec, stmt *ActionStmt) (*ActionArgs, bool) {
+	valid := true
+	args := NewActionArgs(nil)
+	for _, param := range stmt.params {
+		spec, ok := FindParam(specs, param.name)
+		if !ok {
+			self.errorAt(param.line, param.column, "unknown parameter \"%s\" for \"%s\"", param.name, stmt.name)
+			valid = false
+			continue
+		}
+
+		if args.Has(param.name) {
+			self.errorAt(param.line, param.column, "duplicate parameter \"%s\"", param.name)
+			valid = false
+			continue
+		}
+
+		switch {
+		case spec.Kind == ParamUint32 && param.kind == TokenNumber:
+			if err := spec.Check(param.value); err != nil {
+				self.errorAt(param.line, param.column, "%v", err)
+				valid = false
+				continue
+			}
+			args.values[param.name] = param.value
+		case spec.Kind == ParamString && param.kind != TokenNumber:
+			args.strs[param.name] = param.str
+		case spec.Kind == ParamTopology && param.kind != TokenNumber:
+			topology, ok := self.resolveTopology(param)
+			if !ok {
+				valid = false
+				continue
+			}
+			args.topologies[param.name] = topology
+		case spec.Kind == ParamUint32:
+			self.errorAt(param.line, param.column, "parameter \"%s\" must be a number", param.name)
+			valid = false
+		default:
+			self.errorAt(param.line, param.column, "parameter \"%s\" must not be a number", param.name)
+			valid = false
+		}
+	}
+	return args, valid
+}
+
+func (self *Parser) checkStmt(stmt *ActionStmt) (Action, bool) {
+	spec, ok := LookupAction(stmt.name)
+	if !ok {
+		self.errorAt(stmt.line, stmt.column, "unknown action \"%s\"", stmt.name)
+		return nil, false
+	}
+
+	args, ok := self.collectParams(spec.Params, stmt)
+	if !ok {
+		return nil, false
+	}
+
+	action, errors := spec.Build(args)
+	for _, err := range errors {
+		self.errorAt(stmt.line, stmt.column, "%v", err)
+	}
+	return action, len(errors) == 0
+}
+
+func (self *Parser) parseOne() {
+	stmt, ok := self.parseStmt()
+	if !ok {
+		self.skipLine()
+		return
+	}
+
+	if stmt == nil {
+		return
+	}
+
+	if action, ok := self.checkStmt(stmt); ok {
+		self.addAction(action, stmt.line, stmt.column)
+	}
+}
+
+func (self *Parser) parseAll() {
+	for self.tok.kind != TokenEOF {
+		switch self.tok.kind {
+		case TokenNewline:
+			self.next()
+		case TokenRBrace:
+			self.errorAt(self.tok.line, self.tok.column, "unexpected %s", self.tok)
+			self.next()
+		default:
+			self.parseOne()
+		}
+	}
+}
+
+func (self *Parser) Parse() (*ActionList, []*ParseError) {
+	if abs, err := filepath.Abs(self.filename); err == nil {
+		self.ctx.includes = append(self.ctx.includes, abs)
+	}
+	self.parseAll()
+
+	if len(self.ctx.errors) > 0 {
+		return nil, self.ctx.errors
+	}
+	self.ctx.actions.warnings = self.ctx.warnings
+	return self.ctx.actions, nil
+}
+
+func ParseActions(filename, src string) (*ActionList, []*ParseError) {
+	return NewParser(filename, src, NewParseContext()).Parse()
+}
+
+func FormatAction(action Action) string {
+	if expect, ok := action.(*ActionExpect); ok {
+		return "expect: " + expect.cond.String()
+	}
+	if preview, ok := action.(*ActionPreview); ok {
+		return "preview: " + FormatAction(preview.action)
+	}
+
+	spec, ok := LookupAction(action.Name())
+	if !ok {
+		return action.Name() + ":"
+	}
+
+	args := ArgsOf(action)
+	str := action.Name() + ":"
+	for _, v := range spec.Params {
+		if !args.Has(v.Name) {
+			continue
+		}
+		if len(str) > len(action.Name())+1 {
+			str += ","
+		}
+
+		if val, ok := args.values[v.Name]; ok {
+			str += fmt.Sprintf(" %s = %d", v.Name, val)
+		} else if val, ok := args.strs[v.Name]; ok {
+			str += fmt.Sprintf(" %s = %q", v.Name, val)
+		} else if topology := args.topologies[v.Name]; len(topology.file) > 0 {
+			str += fmt.Sprintf(" %s = %q", v.Name, topology.file)
+		} else {
+			str += fmt.Sprintf(" %s = %s", v.Name, topology.name)
+		}
+	}
+	return str
+}
+
+// Expand writes the action list with loops, variables and includes expanded.
+// Inline topologies are written once, before the first action using them.
+func (self *ActionList) Expand(w io.Writer) {
+	self.expand(w, "", make(map[*Topology]bool), make(map[string]bool))
+}
+
+func (self *ActionList) expand(w io.Writer, indent string, written map[*Topology]bool, names map[string]bool) {
+	for _, v := range self.actions {
+		if branch, ok := v.(*ActionBranch); ok {
+			fmt.Fprintf(w, "%sbranch {\n", indent)
+			for _, alt := range branch.alts {
+				fmt.Fprintf(w, "%s    alt %s {\n", indent, alt.name)
+				alt.actions.expand(w, indent+"        ", written, names)
+				fmt.Fprintf(w, "%s    }\n", indent)
+			}
+			fmt.Fprintf(w, "%s}\n", indent)
+			continue
+		}
+
+		for _, topology := range ArgsOf(v).topologies {
+			if len(topology.file) > 0 || written[topology] {
+				continue
+			}
+
+			for i := len(written) + 1; len(topology.name) == 0 || names[topology.name]; i++ {
+				topology.name = fmt.Sprintf("topology%d", i)
+			}
+			written[topology] = true
+			names[topology.name] = true
+			fmt.Fprintf(w, "%stopology %s {\n%s%s}\n", indent, topology.name, topology.Cfg(indent+"    "), indent)
+		}
+		fmt.Fprintf(w, "%s%s\n", indent, FormatAction(v))
+	}
+}
+
+func ParseLine(line string) (Action, bool) {
+	actions, errors := ParseActions("<line>", line)
+	if len(errors) > 0 || len(actions.actions) != 1 {
+		return nil, false
+	}
+	return actions.actions[0], true
+}
+
+func ParseFile(filename string) *ActionList {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		fmt.Printf("ERROR: cannot open file %s\n", filename)
+		return nil
+	}
+
+	actions, errors := ParseScenario(filename, string(data))
+	for _, v := range errors {
+		fmt.Printf("ERROR: %s\n", v.Error())
+	}
+	return actions
+}
@@ -0,0 +1,135 @@
+package sim
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"straw2"
+)
+
+// A migration plan lists the keys moved by the change that made a device,
+// grouped into batches for data movement tooling. It is csv, one move per
+// row, or json when the file name ends in .json.
+
+type PlanMove struct {
+	Key      uint32 `json:"key"`
+	FromMgId uint32 `json:"from_mg_id"`
+	FromPeId uint32 `json:"from_pe_id"`
+	ToMgId   uint32 `json:"to_mg_id"`
+	ToPeId   uint32 `json:"to_pe_id"`
+}
+
+type PlanBatch struct {
+	Batch int         `json:"batch"`
+	Moves []*PlanMove `json:"moves"`
+}
+
+type Plan struct {
+	Limit   uint32       `json:"limit"`
+	Moves   int          `json:"moves"`
+	Batches []*PlanBatch `json:"batches"`
+}
+
+// NewPlan returns the moves of device sorted by key, in batches in which no
+// PE takes part in more than limit moves. limit 0 means one batch.
+func NewPlan(device *straw2.Device, limit uint32) *Plan {
+	moves := append([]straw2.Move{}, device.Moves...)
+	straw2.SortMoves(moves)
+
+	plan := &Plan{Limit: limit, Moves: len(moves), Batches: make([]*PlanBatch, 0)}
+	for i, batch := range straw2.PlanBatches(moves, limit) {
+		report := &PlanBatch{Batch: i + 1, Moves: make([]*PlanMove, 0, len(batch))}
+		for _, v := range batch {
+			report.Moves = append(report.Moves, &PlanMove{Key: v.Key, FromMgId: v.FromMgId, FromPeId: v.FromPeId, ToMgId: v.ToMgId, ToPeId: v.ToPeId})
+		}
+		plan.Batches = append(plan.Batches, report)
+	}
+	return plan
+}
+
+func (self *Plan) Json() (string, error) {
+	data, err := json.MarshalIndent(self, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data) + "\n", nil
+}
+
+func (self *Plan) Csv() string {
+	buf := &bytes.Buffer{}
+	writer := csv.NewWriter(buf)
+	writer.Write([]string{"batch", "key", "from_mg_id", "from_pe_id", "to_mg_id", "to_pe_id"})
+	for _, batch := range self.Batches {
+		for _, v := range batch.Moves {
+			writer.Write([]string{fmt.Sprintf("%d", batch.Batch), fmt.Sprintf("%d", v.Key),
+				fmt.Sprintf("%d", v.FromMgId), fmt.Sprintf("%d", v.FromPeId),
+				fmt.Sprintf("%d", v.ToMgId), fmt.Sprintf("%d", v.ToPeId)})
+		}
+	}
+	writer.Flush()
+	return buf.String()
+}
+
+// WritePlanFile writes plan as json or csv according to the extension of
+// filename.
+func WritePlanFile(filename string, plan *Plan) error {
+	if strings.ToLower(filepath.Ext(filename)) == ".json" {
+		str, err := plan.Json()
+		if err != nil {
+			return err
+		}
+		return WriteFile(filename, str)
+	}
+	return WriteFile(filename, plan.Csv())
+}
+
+// ActionExportPlan writes the migration plan of the action before it, also
+// of a previewed one and under -dry-run.
+type ActionExportPlan struct {
+	file  string
+	limit uint32
+}
+
+func NewActionExportPlan(args *ActionArgs) (Action, error) {
+	if len(args.strs["file"]) == 0 {
+		return nil, fmt.Errorf("export_plan needs a file name")
+	}
+	return &ActionExportPlan{file: args.strs["file"], limit: args.values["limit"]}, nil
+}
+
+func (self *ActionExportPlan) Run(sbc *straw2.Device) (*straw2.Device, error) {
+	if sbc == nil {
+		return nil, ErrNoDevice
+	}
+	if err := WritePlanFile(self.file, NewPlan(sbc, self.limit)); err != nil {
+		return sbc, err
+	}
+	return sbc, nil
+}
+
+func (self *ActionExportPlan) Params() map[string]uint32 {
+	return map[string]uint32{
+		"limit": self.limit,
+	}
+}
+
+func (self *ActionExportPlan) Args() *ActionArgs {
+	args := NewActionArgs(self.Params())
+	args.strs["file"] = self.file
+	return args
+}
+
+func (self *ActionExportPlan) Name() string {
+	return "export_plan"
+}
+
+func (self *ActionExportPlan) Enter() string {
+	str := fmt.Sprintf("---------------------------------------------------------------------\n")
+	str += fmt.Sprintf(Msg("enter_export_plan"), self.file, self.limit)
+	str += fmt.Sprintf("---------------------------------------------------------------------\n")
+	return str
+}
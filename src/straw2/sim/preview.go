@@ -0,0 +1,68 @@
+package sim
+
+import (
+	"straw2"
+)
+
+// ActionPreview runs an action and reports its moves and the balance after
+// it, then goes on with the device from before the action.
+type ActionPreview struct {
+	action Action
+}
+
+func (self *ActionPreview) Run(sbc *straw2.Device) (*straw2.Device, error) {
+	return self.action.Run(sbc)
+}
+
+func (self *ActionPreview) Params() map[string]uint32 {
+	return self.action.Params()
+}
+
+func (self *ActionPreview) Args() *ActionArgs {
+	return ArgsOf(self.action)
+}
+
+func (self *ActionPreview) Name() string {
+	return self.action.Name()
+}
+
+func (self *ActionPreview) Enter() string {
+	return self.action.Enter()
+}
+
+// previewable reports whether action runs like any other action, those
+// runActions handles itself cannot be previewed.
+func previewable(action Action) bool {
+	switch action.(type) {
+	case *ActionCheckpoint, *ActionRestore, *ActionVerify, *ActionWhere, *ActionMigrationModel,
+		*ActionSave, *ActionExportCrushMap, *ActionExportPlan:
+		return false
+	}
+	return true
+}
+
+// parsePreview parses "preview: ACTION: PARAMS".
+func (self *Parser) parsePreview(keyword *Token) bool {
+	if _, ok := self.expect(TokenColon); !ok {
+		return false
+	}
+
+	stmt, ok := self.parseStmt()
+	if !ok || stmt == nil {
+		if ok {
+			self.errorAt(keyword.line, keyword.column, "preview needs an action on the same line")
+		}
+		return false
+	}
+
+	action, ok := self.checkStmt(stmt)
+	if !ok {
+		return false
+	}
+	if !previewable(action) {
+		self.errorAt(stmt.line, stmt.column, "cannot preview \"%s\"", stmt.name)
+		return false
+	}
+	self.addAction(&ActionPreview{action: action}, keyword.line, keyword.column)
+	return true
+}
@@ -0,0 +1,89 @@
+package sim
+
+import (
+	"fmt"
+	"io"
+
+	"straw2"
+)
+
+func StatString(stat *straw2.DistributeStat) string {
+	return fmt.Sprintf(Msg("stat"), stat.AverageBias, stat.AverageBiasPercent*100, stat.MaxBias, stat.MaxBiasPercent*100)
+}
+
+func MigrateString(migrate *straw2.MigrateStat) string {
+	return fmt.Sprintf(Msg("migrate"), migrate.MigrateIn, migrate.MigrateOut)
+}
+
+func PrintSimpleInfo(w io.Writer, device *straw2.Device) {
+	fmt.Fprintf(w, Msg("device_total"), device.Id, device.Total)
+	for _, mg := range device.Mgs {
+		fmt.Fprintf(w, Msg("mg_total_migrate"), mg.Id, mg.Total, MigrateString(&mg.Migrate))
+		for _, pe := range mg.Pes {
+			io.WriteString(w, "    ")
+			fmt.Fprintf(w, Msg("pe_simple_info"), pe.Id, len(pe.Data), MigrateString(&pe.Migrate))
+		}
+	}
+}
+
+func PrintSummary(w io.Writer, device *straw2.Device) {
+	fmt.Fprintf(w, Msg("device_total"), device.Id, device.Total)
+	for _, mg := range device.Mgs {
+		fmt.Fprintf(w, Msg("mg_total_migrate"), mg.Id, mg.Total, MigrateString(&mg.Migrate))
+	}
+}
+
+func PrintCount(w io.Writer, device *straw2.Device) {
+	fmt.Fprintf(w, Msg("device_total"), device.Id, device.Total)
+	for _, mg := range device.Mgs {
+		fmt.Fprintf(w, Msg("mg_total"), mg.Id, mg.Total)
+		for _, pe := range mg.Pes {
+			io.WriteString(w, "    ")
+			fmt.Fprintf(w, Msg("pe_count"), pe.Id, len(pe.Data))
+		}
+	}
+}
+
+func PrintWeight(w io.Writer, device *straw2.Device) {
+	fmt.Fprintf(w, Msg("device_weight"), device.Id, device.Weight)
+	for _, mg := range device.Mgs {
+		fmt.Fprintf(w, Msg("mg_weight"), mg.Id, mg.Weight)
+		for _, pe := range mg.Pes {
+			io.WriteString(w, "    ")
+			fmt.Fprintf(w, Msg("pe_weight"), pe.Id, pe.Weight)
+		}
+	}
+}
+
+func PrintData(w io.Writer, device *straw2.Device) {
+	fmt.Fprintf(w, Msg("device_total"), device.Id, device.Total)
+	for _, mg := range device.Mgs {
+		fmt.Fprintf(w, Msg("mg_total"), mg.Id, mg.Total)
+		for _, pe := range mg.Pes {
+			io.WriteString(w, "    ")
+			fmt.Fprintf(w, Msg("pe_data"), pe.Id)
+			for k, _ := range pe.Data {
+				fmt.Fprintf(w, "%d ", k)
+			}
+			io.WriteString(w, "]\n")
+		}
+	}
+}
+
+func PrintStat(w io.Writer, device *straw2.Device) {
+	fmt.Fprintf(w, Msg("device_total"), device.Id, device.Total)
+	for _, mg := range device.Mgs {
+		fmt.Fprintf(w, "MG[%d]: %s\n", mg.Id, StatString(&mg.Stat))
+	}
+	fmt.Fprintf(w, "%s\n", StatString(&device.Stat))
+}
+
+func PrintMigrate(w io.Writer, device *straw2.Device) {
+	fmt.Fprintf(w, "Device[%d]:\n", device.Id)
+	for _, mg := range device.Mgs {
+		fmt.Fprintf(w, "MG[%d]: %s\n", mg.Id, MigrateString(&mg.Migrate))
+		for _, pe := range mg.Pes {
+			fmt.Fprintf(w, "    PE[%d]: %s\n", pe.Id, MigrateString(&pe.Migrate))
+		}
+	}
+}
@@ -0,0 +1,515 @@
+package sim
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+type ParamKind int
+
+const (
+	ParamUint32 ParamKind = iota
+	ParamString
+	ParamTopology
+)
+
+// ParamSpec describes one parameter of an action. A parameter without a
+// default must be given in the actions file unless it is optional.
+type ParamSpec struct {
+	Name       string
+	Help       string
+	Kind       ParamKind
+	Default    uint32
+	HasDefault bool
+	Optional   bool
+	Min        uint32
+	Max        uint32
+}
+
+func (self *ParamSpec) Check(val uint32) error {
+	if val < self.Min {
+		return fmt.Errorf("parameter \"%s\" = %d is less than %d", self.Name, val, self.Min)
+	}
+	if self.Max > 0 && val > self.Max {
+		return fmt.Errorf("parameter \"%s\" = %d is greater than %d", self.Name, val, self.Max)
+	}
+	return nil
+}
+
+func (self *ParamSpec) Usage() string {
+	str := ""
+	switch self.Kind {
+	case ParamString:
+		str = fmt.Sprintf("%s = \"...\"", self.Name)
+	case ParamTopology:
+		str = fmt.Sprintf("%s = NAME|\"FILE\"", self.Name)
+	default:
+		str = fmt.Sprintf("%s = N", self.Name)
+	}
+
+	if self.HasDefault {
+		str += fmt.Sprintf(" (default %d)", self.Default)
+	} else if self.Optional {
+		str += " (optional)"
+	}
+	return str
+}
+
+// ActionArgs holds the parameter values of one action, split by kind.
+type ActionArgs struct {
+	values     map[string]uint32
+	strs       map[string]string
+	topologies map[string]*Topology
+}
+
+func NewActionArgs(values map[string]uint32) *ActionArgs {
+	args := &ActionArgs{values: make(map[string]uint32), strs: make(map[string]string), topologies: make(map[string]*Topology)}
+	for k, v := range values {
+		args.values[k] = v
+	}
+	return args
+}
+
+func (self *ActionArgs) Has(name string) bool {
+	if _, ok := self.values[name]; ok {
+		return true
+	}
+	if _, ok := self.strs[name]; ok {
+		return true
+	}
+	_, ok := self.topologies[name]
+	return ok
+}
+
+// Uint32 returns the value of number parameter name.
+func (self *ActionArgs) Uint32(name string) (uint32, bool) {
+	v, ok := self.values[name]
+	return v, ok
+}
+
+// String returns the value of string parameter name.
+func (self *ActionArgs) String(name string) (string, bool) {
+	v, ok := self.strs[name]
+	return v, ok
+}
+
+// Topology returns the topology of topology parameter name.
+func (self *ActionArgs) Topology(name string) (*Topology, bool) {
+	v, ok := self.topologies[name]
+	return v, ok
+}
+
+func (self *ActionArgs) SetUint32(name string, val uint32) {
+	self.values[name] = val
+}
+
+func (self *ActionArgs) SetString(name, val string) {
+	self.strs[name] = val
+}
+
+func (self *ActionArgs) SetTopology(name string, topology *Topology) {
+	self.topologies[name] = topology
+}
+
+func (self *ActionArgs) Names() []string {
+	names := make([]string, 0, len(self.values)+len(self.strs)+len(self.topologies))
+	for k, _ := range self.values {
+		names = append(names, k)
+	}
+	for k, _ := range self.strs {
+		names = append(names, k)
+	}
+	for k, _ := range self.topologies {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ActionWithArgs is implemented by actions that have parameters which are
+// not uint32, so they can be written back to an actions file.
+type ActionWithArgs interface {
+	Args() *ActionArgs
+}
+
+func ArgsOf(action Action) *ActionArgs {
+	if v, ok := action.(ActionWithArgs); ok {
+		return v.Args()
+	}
+	return NewActionArgs(action.Params())
+}
+
+func FindParam(specs []*ParamSpec, name string) (*ParamSpec, bool) {
+	for _, v := range specs {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// FillParams checks args against specs and fills in the defaults.
+func FillParams(what string, specs []*ParamSpec, args *ActionArgs) []error {
+	errors := make([]error, 0)
+	for _, name := range args.Names() {
+		if _, ok := FindParam(specs, name); !ok {
+			errors = append(errors, fmt.Errorf("unknown parameter \"%s\" for %s", name, what))
+		}
+	}
+
+	for _, v := range specs {
+		if !args.Has(v.Name) {
+			switch {
+			case v.HasDefault:
+				args.values[v.Name] = v.Default
+			case !v.Optional:
+				errors = append(errors, fmt.Errorf("missing parameter \"%s\" for %s", v.Name, what))
+			}
+			continue
+		}
+
+		if val, ok := args.values[v.Name]; ok {
+			if v.Kind != ParamUint32 {
+				errors = append(errors, fmt.Errorf("parameter \"%s\" must not be a number", v.Name))
+			} else if err := v.Check(val); err != nil {
+				errors = append(errors, err)
+			}
+		}
+		if _, ok := args.strs[v.Name]; ok && v.Kind != ParamString {
+			errors = append(errors, fmt.Errorf("parameter \"%s\" must not be a string", v.Name))
+		}
+		if _, ok := args.topologies[v.Name]; ok && v.Kind != ParamTopology {
+			errors = append(errors, fmt.Errorf("parameter \"%s\" must not be a topology", v.Name))
+		}
+	}
+	return errors
+}
+
+// ActionSpec is the registry entry of an action type. New receives every
+// parameter of the schema, with defaults already filled in and validated.
+type ActionSpec struct {
+	Name   string
+	Help   string
+	Params []*ParamSpec
+	New    func(args *ActionArgs) (Action, error)
+}
+
+func (self *ActionSpec) Param(name string) (*ParamSpec, bool) {
+	return FindParam(self.Params, name)
+}
+
+func (self *ActionSpec) Usage() string {
+	str := self.Name + ":"
+	for i, v := range self.Params {
+		if i > 0 {
+			str += ","
+		}
+		str += " " + v.Usage()
+	}
+	return str
+}
+
+// Build fills in defaults, validates every value and constructs the action.
+func (self *ActionSpec) Build(args *ActionArgs) (Action, []error) {
+	errors := FillParams(fmt.Sprintf("action \"%s\"", self.Name), self.Params, args)
+	if len(errors) > 0 {
+		return nil, errors
+	}
+
+	action, err := self.New(args)
+	if err != nil {
+		return nil, []error{err}
+	}
+	return action, nil
+}
+
+var actionRegistry = map[string]*ActionSpec{}
+
+var actionOrder = make([]string, 0)
+
+// RegisterAction adds an action type to the registry, usually from an init
+// function. It returns false if the name is already taken.
+func RegisterAction(spec *ActionSpec) bool {
+	if _, ok := actionRegistry[spec.Name]; ok {
+		return false
+	}
+	actionRegistry[spec.Name] = spec
+	actionOrder = append(actionOrder, spec.Name)
+	return true
+}
+
+func LookupAction(name string) (*ActionSpec, bool) {
+	spec, ok := actionRegistry[name]
+	return spec, ok
+}
+
+func ActionSpecs() []*ActionSpec {
+	specs := make([]*ActionSpec, 0, len(actionOrder))
+	for _, v := range actionOrder {
+		specs = append(specs, actionRegistry[v])
+	}
+	return specs
+}
+
+// SyntaxSpec describes a keyword of the actions file that is not an action.
+type SyntaxSpec struct {
+	Name  string
+	Usage string
+	Help  string
+}
+
+var syntaxSpecs = make([]*SyntaxSpec, 0)
+
+// RegisterSyntax adds a keyword to the help PrintActions writes. It does
+// not change the parser.
+func RegisterSyntax(spec *SyntaxSpec) {
+	syntaxSpecs = append(syntaxSpecs, spec)
+}
+
+func SyntaxSpecs() []*SyntaxSpec {
+	return append([]*SyntaxSpec{}, syntaxSpecs...)
+}
+
+func NewAction(name string, args *ActionArgs) (Action, []error) {
+	spec, ok := LookupAction(name)
+	if !ok {
+		return nil, []error{fmt.Errorf("unknown action \"%s\"", name)}
+	}
+	return spec.Build(args)
+}
+
+func PrintActions(w io.Writer) {
+	for i, spec := range ActionSpecs() {
+		if i > 0 {
+			fmt.Fprintf(w, "\n")
+		}
+		fmt.Fprintf(w, "%s\n    %s\n", spec.Usage(), spec.Help)
+		for _, v := range spec.Params {
+			fmt.Fprintf(w, "    %-12s %s", v.Name, v.Help)
+			if v.Max > 0 {
+				fmt.Fprintf(w, " [%d..%d]", v.Min, v.Max)
+			} else if v.Min > 0 {
+				fmt.Fprintf(w, " [>= %d]", v.Min)
+			}
+			fmt.Fprintf(w, "\n")
+		}
+	}
+	for _, spec := range SyntaxSpecs() {
+		fmt.Fprintf(w, "\n%s\n    %s\n", spec.Usage, spec.Help)
+	}
+}
+
+func init() {
+	RegisterSyntax(&SyntaxSpec{
+		Name:  "expect",
+		Usage: "expect: <value> <op> <value>",
+		Help:  "check a metric of the device after the previous action",
+	})
+	RegisterSyntax(&SyntaxSpec{
+		Name:  "preview",
+		Usage: "preview: ACTION: PARAMS",
+		Help:  "run an action and report it, then go on with the device from before it",
+	})
+	RegisterSyntax(&SyntaxSpec{
+		Name:  "branch",
+		Usage: "branch { alt NAME { ... } ... }",
+		Help:  "run every alternative from the same device and compare them",
+	})
+	RegisterSyntax(&SyntaxSpec{
+		Name:  "let",
+		Usage: "let NAME = EXPR",
+		Help:  "set variable $NAME for the parameters after it",
+	})
+	RegisterSyntax(&SyntaxSpec{
+		Name:  "for",
+		Usage: "for NAME in BEGIN..END [step STEP] { ... }",
+		Help:  "repeat the block with $NAME from BEGIN to END",
+	})
+	RegisterSyntax(&SyntaxSpec{
+		Name:  "repeat",
+		Usage: "repeat COUNT { ... }",
+		Help:  "repeat the block COUNT times",
+	})
+	RegisterSyntax(&SyntaxSpec{
+		Name:  "include",
+		Usage: "include: FILE",
+		Help:  "read the actions of another file, relative to this one",
+	})
+	RegisterSyntax(&SyntaxSpec{
+		Name:  "topology",
+		Usage: "topology NAME { mg: id = ID ... pe: id = ID, weight = W ... }",
+		Help:  "define a topology for the topology parameter of power_on",
+	})
+
+	RegisterAction(&ActionSpec{
+		Name: "power_on",
+		Help: "build a device and place rands_num random keys, either with identical MGs or from a topology",
+		Params: []*ParamSpec{
+			{Name: "rands_num", Help: "number of random keys"},
+			{Name: "mg_num", Help: "number of MGs", Optional: true, Min: 1},
+			{Name: "pe_num", Help: "number of PEs in every MG", Optional: true, Min: 1},
+			{Name: "pe_weight", Help: "weight of every PE", Default: 1, HasDefault: true, Min: 1},
+			{Name: "topology", Help: "topology block name or topology file, instead of mg_num and pe_num", Kind: ParamTopology, Optional: true},
+		},
+		New: NewActionPowerOn,
+	})
+
+	RegisterAction(&ActionSpec{
+		Name: "scale_out",
+		Help: "add a new MG",
+		Params: []*ParamSpec{
+			{Name: "mg_id", Help: "id of the new MG"},
+			{Name: "pe_num", Help: "number of PEs in the new MG", Min: 1},
+			{Name: "pe_weight", Help: "weight of every new PE", Default: 1, HasDefault: true, Min: 1},
+		},
+		New: func(args *ActionArgs) (Action, error) {
+			return &ActionScaleOut{mg_id: args.values["mg_id"], pe_num: args.values["pe_num"], pe_weight: args.values["pe_weight"]}, nil
+		},
+	})
+
+	RegisterAction(&ActionSpec{
+		Name: "scale_in",
+		Help: "remove an MG",
+		Params: []*ParamSpec{
+			{Name: "mg_id", Help: "id of the MG to remove"},
+		},
+		New: func(args *ActionArgs) (Action, error) {
+			return &ActionScaleIn{mg_id: args.values["mg_id"]}, nil
+		},
+	})
+
+	RegisterAction(&ActionSpec{
+		Name: "scale_up",
+		Help: "add a PE to an MG",
+		Params: []*ParamSpec{
+			{Name: "mg_id", Help: "id of the MG"},
+			{Name: "pe_id", Help: "id of the new PE"},
+			{Name: "pe_weight", Help: "weight of the new PE", Default: 1, HasDefault: true, Min: 1},
+		},
+		New: func(args *ActionArgs) (Action, error) {
+			return &ActionScaleUp{mg_id: args.values["mg_id"], pe_id: args.values["pe_id"], pe_weight: args.values["pe_weight"]}, nil
+		},
+	})
+
+	RegisterAction(&ActionSpec{
+		Name: "scale_down",
+		Help: "remove a PE from an MG",
+		Params: []*ParamSpec{
+			{Name: "mg_id", Help: "id of the MG"},
+			{Name: "pe_id", Help: "id of the PE to remove"},
+		},
+		New: func(args *ActionArgs) (Action, error) {
+			return &ActionScaleDown{mg_id: args.values["mg_id"], pe_id: args.values["pe_id"]}, nil
+		},
+	})
+
+	RegisterAction(&ActionSpec{
+		Name: "reweight",
+		Help: "change the weight of a PE, and with it of its MG",
+		Params: []*ParamSpec{
+			{Name: "mg_id", Help: "id of the MG"},
+			{Name: "pe_id", Help: "id of the PE"},
+			{Name: "weight", Help: "new weight of the PE, 0 drains it"},
+		},
+		New: func(args *ActionArgs) (Action, error) {
+			return &ActionReweight{mg_id: args.values["mg_id"], pe_id: args.values["pe_id"], weight: args.values["weight"]}, nil
+		},
+	})
+
+	RegisterAction(&ActionSpec{
+		Name: "export_crushmap",
+		Help: "write the device as a Ceph crushmap text file",
+		Params: []*ParamSpec{
+			{Name: "file", Help: "crushmap file name", Kind: ParamString},
+		},
+		New: NewActionExportCrushMap,
+	})
+
+	RegisterAction(&ActionSpec{
+		Name: "migration_model",
+		Help: "time the moves of the actions after it from key size, bandwidths and backfill limits",
+		Params: []*ParamSpec{
+			{Name: "key_size", Help: "size of every key in KiB", Default: 4096, HasDefault: true, Min: 1},
+			{Name: "pe_bandwidth", Help: "MiB/s a PE reads and writes, shared by its moves", Default: 100, HasDefault: true, Min: 1},
+			{Name: "mg_bandwidth", Help: "MiB/s of network in and out of an MG for moves between MGs, 0 for no limit", Default: 0, HasDefault: true},
+			{Name: "max_backfills", Help: "most moves a PE takes part in at once", Default: 1, HasDefault: true, Min: 1},
+			{Name: "step", Help: "seconds between points of the progress curve, 0 for 20 points", Default: 0, HasDefault: true},
+		},
+		New: func(args *ActionArgs) (Action, error) {
+			return &ActionMigrationModel{model: MigrationModel{
+				KeySize:      args.values["key_size"],
+				PeBandwidth:  args.values["pe_bandwidth"],
+				MgBandwidth:  args.values["mg_bandwidth"],
+				MaxBackfills: args.values["max_backfills"],
+				Step:         args.values["step"],
+			}}, nil
+		},
+	})
+
+	RegisterAction(&ActionSpec{
+		Name: "export_plan",
+		Help: "write the keys moved by the action before, in batches, as csv or json by the file extension",
+		Params: []*ParamSpec{
+			{Name: "file", Help: "plan file name", Kind: ParamString},
+			{Name: "limit", Help: "most moves a PE sends and receives per batch, 0 for one batch", Default: 0, HasDefault: true},
+		},
+		New: NewActionExportPlan,
+	})
+
+	RegisterAction(&ActionSpec{
+		Name: "save",
+		Help: "write the whole device state to a versioned binary file",
+		Params: []*ParamSpec{
+			{Name: "file", Help: "state file name", Kind: ParamString},
+		},
+		New: NewActionSave,
+	})
+
+	RegisterAction(&ActionSpec{
+		Name: "load",
+		Help: "replace the device with a state written by save",
+		Params: []*ParamSpec{
+			{Name: "file", Help: "state file name", Kind: ParamString},
+		},
+		New: NewActionLoad,
+	})
+
+	RegisterAction(&ActionSpec{
+		Name: "checkpoint",
+		Help: "remember the device under a name",
+		Params: []*ParamSpec{
+			{Name: "name", Help: "checkpoint name", Kind: ParamString},
+		},
+		New: NewActionCheckpoint,
+	})
+
+	RegisterAction(&ActionSpec{
+		Name: "restore",
+		Help: "continue from the device remembered by an earlier checkpoint",
+		Params: []*ParamSpec{
+			{Name: "name", Help: "checkpoint name", Kind: ParamString},
+		},
+		New: NewActionRestore,
+	})
+
+	RegisterAction(&ActionSpec{
+		Name: "where",
+		Help: "explain where a key is placed: every draw of both buckets, and the PEs it has been on",
+		Params: []*ParamSpec{
+			{Name: "key", Help: "the key to trace"},
+		},
+		New: func(args *ActionArgs) (Action, error) {
+			return &ActionWhere{key: args.values["key"]}, nil
+		},
+	})
+
+	RegisterAction(&ActionSpec{
+		Name:   "verify",
+		Help:   "check that every key is where Select puts it and that weights, totals and buckets add up",
+		Params: []*ParamSpec{},
+		New: func(args *ActionArgs) (Action, error) {
+			return &ActionVerify{}, nil
+		},
+	})
+}
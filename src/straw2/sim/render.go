@@ -0,0 +1,173 @@
+package sim
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"straw2"
+)
+
+type Verbosity int
+
+const (
+	VerbositySummary Verbosity = iota
+	VerbosityCounts
+	VerbosityWeights
+	VerbosityData
+)
+
+var verbosityNames = []string{"summary", "counts", "weights", "data"}
+
+func (self Verbosity) String() string {
+	if int(self) < len(verbosityNames) {
+		return verbosityNames[self]
+	}
+	return fmt.Sprintf("verbosity(%d)", int(self))
+}
+
+func ParseVerbosity(name string) (Verbosity, bool) {
+	for i, v := range verbosityNames {
+		if v == name {
+			return Verbosity(i), true
+		}
+	}
+	return VerbosityCounts, false
+}
+
+type Renderer struct {
+	verbosity Verbosity
+	writer    io.Writer
+	sinks     []*bufio.Writer
+	closers   []io.Closer
+}
+
+func NewRenderer(verbosity Verbosity) *Renderer {
+	return &Renderer{verbosity: verbosity, writer: io.Discard}
+}
+
+func (self *Renderer) AddSink(w io.Writer) {
+	self.sinks = append(self.sinks, bufio.NewWriter(w))
+
+	writers := make([]io.Writer, 0, len(self.sinks))
+	for _, v := range self.sinks {
+		writers = append(writers, v)
+	}
+	self.writer = io.MultiWriter(writers...)
+}
+
+func (self *Renderer) AddFileSink(filename string) bool {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		fmt.Printf("ERROR: cannot open file %s to write\n", filename)
+		return false
+	}
+
+	if strings.HasSuffix(filename, ".gz") {
+		zip := gzip.NewWriter(file)
+		self.AddSink(zip)
+		self.closers = append(self.closers, zip)
+	} else {
+		self.AddSink(file)
+	}
+	self.closers = append(self.closers, file)
+	return true
+}
+
+func (self *Renderer) Writer() io.Writer {
+	return self.writer
+}
+
+func (self *Renderer) Flush() {
+	for _, v := range self.sinks {
+		v.Flush()
+	}
+}
+
+func (self *Renderer) Close() {
+	self.Flush()
+	for _, v := range self.closers {
+		v.Close()
+	}
+	self.sinks = nil
+	self.closers = nil
+	self.writer = io.Discard
+}
+
+func (self *Renderer) Enter(action Action) {
+	io.WriteString(self.writer, action.Enter())
+	self.Flush()
+}
+
+func (self *Renderer) Result(device *straw2.Device, elapsed time.Duration) {
+	if self.verbosity == VerbositySummary {
+		PrintSummary(self.writer, device)
+	} else {
+		PrintSimpleInfo(self.writer, device)
+	}
+
+	if self.verbosity >= VerbosityWeights {
+		PrintWeight(self.writer, device)
+	}
+
+	if self.verbosity >= VerbosityData {
+		PrintData(self.writer, device)
+	}
+
+	fmt.Fprintf(self.writer, Msg("use_time"), elapsed)
+	self.Flush()
+}
+
+func (self *Renderer) Expect(expect *ActionExpect, ok bool) {
+	if ok {
+		fmt.Fprintf(self.writer, Msg("expect_ok"), expect.cond)
+	} else {
+		fmt.Fprintf(self.writer, Msg("expect_failed"), expect.cond)
+	}
+	self.Flush()
+}
+
+func (self *Renderer) Timing(report *TimingReport) {
+	PrintTiming(self.writer, report, self.verbosity >= VerbosityWeights)
+	self.Flush()
+}
+
+func (self *Renderer) Previewed() {
+	io.WriteString(self.writer, Msg("preview_discarded"))
+	self.Flush()
+}
+
+func (self *Renderer) Verified(device *straw2.Device) {
+	fmt.Fprintf(self.writer, Msg("verify_ok"), device.Total)
+	self.Flush()
+}
+
+func (self *Renderer) Where(trace *straw2.Trace, steps []*KeyStep) {
+	PrintTrace(self.writer, trace)
+	PrintKeySteps(self.writer, trace.Key, steps)
+	self.Flush()
+}
+
+func (self *Renderer) Error(err error) {
+	fmt.Fprintf(self.writer, Msg("action_error"), err)
+	self.Flush()
+}
+
+func (self *Renderer) Warning(msg string) {
+	fmt.Fprintf(self.writer, Msg("warning"), msg)
+	self.Flush()
+}
+
+func (self *Renderer) Alt(name string) {
+	fmt.Fprintf(self.writer, Msg("branch_alt"), name)
+	self.Flush()
+}
+
+func (self *Renderer) Branch(report *BranchReport) {
+	io.WriteString(self.writer, report.String())
+	self.Flush()
+}
@@ -0,0 +1,460 @@
+package sim
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"straw2"
+)
+
+// ReplUndoDepth is how many inputs undo can take back.
+const ReplUndoDepth = 32
+
+var replCommands = []string{"where ", "trace ", "show ", "stats", "undo", "history", "save ", "preview: ", "help", "quit"}
+
+// Repl runs actions typed one input at a time on a device that persists
+// between inputs, and answers inspection commands about it.
+type Repl struct {
+	out         io.Writer
+	verbosity   Verbosity
+	policy      RunPolicy
+	verify      bool
+	dryRun      bool
+	ctx         *ParseContext
+	checkpoints map[string]*straw2.Device
+	model       *MigrationModel
+	device      *straw2.Device
+	undo        []*replState
+	history     []string
+}
+
+// replState is what an input changes, the undo stack holds it for every
+// input applied.
+type replState struct {
+	device      *straw2.Device
+	model       *MigrationModel
+	checkpoints map[string]*straw2.Device
+	vars        map[string]int64
+	topologies  map[string]*Topology
+	names       map[string]bool
+}
+
+func copyCheckpoints(checkpoints map[string]*straw2.Device) map[string]*straw2.Device {
+	result := make(map[string]*straw2.Device, len(checkpoints))
+	for k, v := range checkpoints {
+		result[k] = v
+	}
+	return result
+}
+
+// state returns the state before the next input. The maps are copied, so
+// parsing and running the input does not change it.
+func (self *Repl) state() *replState {
+	state := &replState{device: self.device, model: self.model, checkpoints: copyCheckpoints(self.checkpoints),
+		vars: make(map[string]int64, len(self.ctx.vars)), topologies: make(map[string]*Topology, len(self.ctx.topologies)),
+		names: make(map[string]bool, len(self.ctx.checkpoints))}
+	for k, v := range self.ctx.vars {
+		state.vars[k] = v
+	}
+	for k, v := range self.ctx.topologies {
+		state.topologies[k] = v
+	}
+	for k, v := range self.ctx.checkpoints {
+		state.names[k] = v
+	}
+	return state
+}
+
+func (self *Repl) restore(state *replState) {
+	self.device = state.device
+	self.model = state.model
+	self.checkpoints = state.checkpoints
+	self.ctx.vars = state.vars
+	self.ctx.topologies = state.topologies
+	self.ctx.checkpoints = state.names
+}
+
+func NewRepl(out io.Writer, verbosity Verbosity) *Repl {
+	return &Repl{out: out, verbosity: verbosity, ctx: NewParseContext(), checkpoints: make(map[string]*straw2.Device)}
+}
+
+func (self *Repl) SetPolicy(policy RunPolicy) {
+	self.policy = policy
+}
+
+func (self *Repl) SetVerify(verify bool) {
+	self.verify = verify
+}
+
+func (self *Repl) SetDryRun(dryRun bool) {
+	self.dryRun = dryRun
+}
+
+// Apply runs actions from the current device. An input is applied whole
+// or not at all: if an action fails the device stays as it was. text is
+// what history and save record for the input.
+func (self *Repl) Apply(actions *ActionList, text string) bool {
+	return self.apply(actions, text, self.state())
+}
+
+// apply is Apply for an input parsed in the context of the repl, state
+// is the one from before parsing it.
+func (self *Repl) apply(actions *ActionList, text string, state *replState) bool {
+	renderer := NewRenderer(self.verbosity)
+	renderer.AddSink(self.out)
+
+	actions.SetPolicy(self.policy)
+	actions.SetVerify(self.verify)
+	actions.SetDryRun(self.dryRun)
+	actions.checkpoints = copyCheckpoints(self.checkpoints)
+	actions.model = self.model
+	device := actions.RunFrom(renderer, self.device)
+	renderer.Flush()
+
+	if len(actions.errors) > 0 {
+		fmt.Fprintf(self.out, "ERROR: %d failure(s), input not applied\n", len(actions.errors))
+		return false
+	}
+
+	self.undo = append(self.undo, state)
+	if len(self.undo) > ReplUndoDepth {
+		self.undo = self.undo[1:]
+	}
+	self.history = append(self.history, strings.TrimRight(text, "\n"))
+	self.device = device
+	self.model = actions.model
+	self.checkpoints = actions.checkpoints
+	return true
+}
+
+// Exec runs one input, an inspection command or actions in cfg syntax. It
+// returns false when the input asks to quit.
+func (self *Repl) Exec(input string) bool {
+	fields := strings.Fields(input)
+	if len(fields) == 0 {
+		return true
+	}
+
+	switch fields[0] {
+	case "quit", "exit":
+		return false
+	case "help":
+		self.help()
+	case "where":
+		self.where(fields[1:])
+	case "trace":
+		self.trace(fields[1:])
+	case "show":
+		self.show(fields[1:])
+	case "stats":
+		if self.device == nil {
+			fmt.Fprintf(self.out, "ERROR: %v\n", ErrNoDevice)
+			break
+		}
+		self.device.CalcStat()
+		PrintStat(self.out, self.device)
+	case "undo":
+		if len(self.undo) == 0 {
+			fmt.Fprintf(self.out, "ERROR: nothing to undo\n")
+			break
+		}
+		self.restore(self.undo[len(self.undo)-1])
+		self.undo = self.undo[:len(self.undo)-1]
+		fmt.Fprintf(self.out, "undo: %s\n", self.history[len(self.history)-1])
+		self.history = self.history[:len(self.history)-1]
+	case "history":
+		for i, v := range self.history {
+			fmt.Fprintf(self.out, "%4d  %s\n", i+1, strings.Replace(v, "\n", "\n      ", -1))
+		}
+	case "save":
+		self.save(strings.TrimSpace(strings.TrimSpace(input)[len(fields[0]):]))
+	default:
+		state := self.state()
+		self.ctx.actions = NewActionList()
+		self.ctx.errors = nil
+		self.ctx.warnings = nil
+		actions, errors := NewParser("<input>", input, self.ctx).Parse()
+		for _, v := range errors {
+			fmt.Fprintf(self.out, "ERROR: %s\n", v.Error())
+		}
+		if len(errors) > 0 || !self.apply(actions, input, state) {
+			self.restore(state)
+		}
+	}
+	return true
+}
+
+// save writes the history to file, a name as in an actions file, in
+// double quotes if it has spaces.
+func (self *Repl) save(file string) {
+	if strings.HasPrefix(file, "\"") {
+		name, err := strconv.Unquote(file)
+		if err != nil {
+			fmt.Fprintf(self.out, "ERROR: bad file name %s\n", file)
+			return
+		}
+		file = name
+	} else if len(file) == 0 || len(strings.Fields(file)) != 1 {
+		fmt.Fprintf(self.out, "ERROR: usage: save <actions file>\n")
+		return
+	}
+	if err := WriteFile(file, strings.Join(self.history, "\n")+"\n"); err != nil {
+		fmt.Fprintf(self.out, "ERROR: %v\n", err)
+		return
+	}
+	fmt.Fprintf(self.out, "saved %d input(s) to %s\n", len(self.history), file)
+}
+
+func (self *Repl) help() {
+	io.WriteString(self.out, `actions          any line of an actions file, e.g. "scale_out: mg_id = 11, pe_num = 20"
+preview: ACTION  the moves and balance of an action, without applying it
+where KEY        the MG and PE KEY is placed on, and whether it is stored there
+trace KEY        every draw that places KEY, and the PEs it was on after each input
+show mg ID       weight, keys and migrations of an MG and its PEs
+show pe MG PE    weight, keys and migrations of a PE
+stats            distribution of the device against the weight targets
+undo             take back the last input
+history          the inputs applied so far
+save FILE        write the history as an actions file
+quit             leave
+`)
+}
+
+func (self *Repl) parseIds(args []string, names ...string) ([]uint32, bool) {
+	if len(args) != len(names) {
+		fmt.Fprintf(self.out, "ERROR: expected %s\n", strings.Join(names, " "))
+		return nil, false
+	}
+	ids := make([]uint32, 0, len(args))
+	for i, v := range args {
+		id, err := strconv.ParseUint(v, 0, 32)
+		if err != nil {
+			fmt.Fprintf(self.out, "ERROR: bad %s \"%s\"\n", names[i], v)
+			return nil, false
+		}
+		ids = append(ids, uint32(id))
+	}
+	if self.device == nil {
+		fmt.Fprintf(self.out, "ERROR: %v\n", ErrNoDevice)
+		return nil, false
+	}
+	return ids, true
+}
+
+func (self *Repl) where(args []string) {
+	ids, ok := self.parseIds(args, "KEY")
+	if !ok {
+		return
+	}
+
+	key := ids[0]
+	mg_id, pe_id, err := self.device.Select(key)
+	if err != nil {
+		fmt.Fprintf(self.out, "ERROR: %v\n", err)
+		return
+	}
+
+	mg_index, _ := self.device.GetMgIndex(mg_id)
+	mg := self.device.Mgs[mg_index]
+	pe_index, _ := mg.GetPeIndex(pe_id)
+	_, stored := mg.Pes[pe_index].Data[key]
+	fmt.Fprintf(self.out, "key %d: MG[%d] PE[%d], stored = %v\n", key, mg_id, pe_id, stored)
+}
+
+func (self *Repl) trace(args []string) {
+	ids, ok := self.parseIds(args, "KEY")
+	if !ok {
+		return
+	}
+
+	trace, err := self.device.Trace(ids[0])
+	if err != nil {
+		fmt.Fprintf(self.out, "ERROR: %v\n", err)
+		return
+	}
+
+	// undo holds the states before the last len(undo) inputs.
+	devices := make([]*straw2.Device, 0, len(self.undo)+1)
+	for _, v := range self.undo {
+		devices = append(devices, v.device)
+	}
+	devices = append(devices, self.device)
+	first := len(self.history) - len(self.undo)
+	steps := make([]*KeyStep, 0, len(devices))
+	for i, device := range devices {
+		if device == nil {
+			continue
+		}
+		step := &KeyStep{Index: first + i, Action: "start"}
+		if step.Index > 0 {
+			step.Action = strings.SplitN(self.history[step.Index-1], "\n", 2)[0]
+		}
+		if v, err := device.Trace(ids[0]); err != nil {
+			step.Err = err
+		} else {
+			step.MgId, step.PeId, step.Stored = v.MgId, v.PeId, v.Stored
+		}
+		steps = append(steps, step)
+	}
+
+	PrintTrace(self.out, trace)
+	PrintKeySteps(self.out, trace.Key, steps)
+}
+
+func (self *Repl) show(args []string) {
+	if len(args) == 0 || (args[0] != "mg" && args[0] != "pe") {
+		fmt.Fprintf(self.out, "ERROR: usage: show mg ID | show pe MG PE\n")
+		return
+	}
+
+	var ids []uint32
+	var ok bool
+	if args[0] == "mg" {
+		ids, ok = self.parseIds(args[1:], "ID")
+	} else {
+		ids, ok = self.parseIds(args[1:], "MG", "PE")
+	}
+	if !ok {
+		return
+	}
+
+	mg_index, err := self.device.GetMgIndex(ids[0])
+	if err != nil {
+		fmt.Fprintf(self.out, "ERROR: %v\n", err)
+		return
+	}
+	mg := self.device.Mgs[mg_index]
+	mg.CalcStat()
+
+	if args[0] == "pe" {
+		pe_index, err := mg.GetPeIndex(ids[1])
+		if err != nil {
+			fmt.Fprintf(self.out, "ERROR: %v\n", err)
+			return
+		}
+		pe := mg.Pes[pe_index]
+		fmt.Fprintf(self.out, "MG[%d] PE[%d]: weight = %d, count = %d, %s\n", mg.Id, pe.Id, pe.Weight, len(pe.Data), MigrateString(&pe.Migrate))
+		return
+	}
+
+	fmt.Fprintf(self.out, "MG[%d]: weight = %d, total = %d, %s\n", mg.Id, mg.Weight, mg.Total, MigrateString(&mg.Migrate))
+	fmt.Fprintf(self.out, "MG[%d]: %s\n", mg.Id, StatString(&mg.Stat))
+	for _, pe := range mg.Pes {
+		fmt.Fprintf(self.out, "    PE[%d]: weight = %d, count = %d, %s\n", pe.Id, pe.Weight, len(pe.Data), MigrateString(&pe.Migrate))
+	}
+}
+
+// Complete returns the completions of line: action and command names, the
+// unused parameter names of an action, also after preview:, and the kinds
+// of show.
+func (self *Repl) Complete(line string) []string {
+	candidates := make([]string, 0)
+	if trimmed := strings.TrimLeft(line, " "); strings.HasPrefix(trimmed, "preview:") {
+		rest := strings.TrimLeft(trimmed[len("preview:"):], " ")
+		head := line[:len(line)-len(rest)]
+		for _, v := range self.Complete(rest) {
+			if strings.Contains(v, ":") {
+				candidates = append(candidates, head+v)
+			}
+		}
+		return candidates
+	}
+
+	colon := strings.Index(line, ":")
+	if colon < 0 {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || (len(fields) == 1 && !strings.HasSuffix(line, " ")) {
+			word := strings.TrimLeft(line, " ")
+			for _, spec := range ActionSpecs() {
+				if strings.HasPrefix(spec.Name+": ", word) {
+					candidates = append(candidates, spec.Name+": ")
+				}
+			}
+			for _, v := range replCommands {
+				if strings.HasPrefix(v, word) {
+					candidates = append(candidates, v)
+				}
+			}
+			return candidates
+		}
+
+		if fields[0] == "show" && len(fields) <= 2 {
+			word := ""
+			if len(fields) == 2 {
+				word = fields[1]
+			}
+			for _, v := range []string{"mg ", "pe "} {
+				if strings.HasPrefix(v, word) {
+					candidates = append(candidates, "show "+v)
+				}
+			}
+		}
+		return candidates
+	}
+
+	spec, ok := LookupAction(strings.TrimSpace(line[:colon]))
+	if !ok {
+		return candidates
+	}
+
+	start := strings.LastIndexAny(line, ":,") + 1
+	word := strings.TrimLeft(line[start:], " ")
+	if strings.Contains(word, "=") {
+		return candidates
+	}
+
+	used := make(map[string]bool)
+	for _, v := range strings.Split(line[colon+1:start], ",") {
+		if i := strings.Index(v, "="); i >= 0 {
+			used[strings.TrimSpace(v[:i])] = true
+		}
+	}
+
+	head := line[:len(line)-len(word)]
+	for _, v := range spec.Params {
+		if !used[v.Name] && strings.HasPrefix(v.Name, word) {
+			candidates = append(candidates, head+v.Name+" = ")
+		}
+	}
+	return candidates
+}
+
+// RunInteractive reads inputs from stdin until quit or the end of the
+// input. actions, if not nil, runs first as if typed.
+func RunInteractive(repl *Repl, actions *ActionList) {
+	if actions != nil && len(actions.actions) > 0 {
+		repl.Apply(actions, actions.Cfg())
+	}
+
+	editor := NewLineEditor(os.Stdin, repl.out, repl.Complete)
+	input := ""
+	for {
+		prompt := "straw2> "
+		if len(input) > 0 {
+			prompt = "...     "
+		}
+
+		line, err := editor.ReadLine(prompt)
+		if err != nil {
+			io.WriteString(repl.out, "\n")
+			return
+		}
+		editor.AddHistory(line)
+
+		// Blocks like topology and branch take lines until their braces
+		// are closed.
+		input += line + "\n"
+		if strings.Count(input, "{") > strings.Count(input, "}") {
+			continue
+		}
+
+		ok := repl.Exec(strings.TrimRight(input, "\n"))
+		input = ""
+		if !ok {
+			return
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package sim
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"straw2"
+)
+
+const ReportVersion = 1
+
+type StatReport struct {
+	AverageBias        float64 `json:"average_bias"`
+	AverageBiasPercent float64 `json:"average_bias_percent"`
+	MaxBias            uint32  `json:"max_bias"`
+	MaxBiasPercent     float64 `json:"max_bias_percent"`
+}
+
+func NewStatReport(stat *straw2.DistributeStat) StatReport {
+	return StatReport{
+		AverageBias:        stat.AverageBias,
+		AverageBiasPercent: stat.AverageBiasPercent * 100,
+		MaxBias:            stat.MaxBias,
+		MaxBiasPercent:     stat.MaxBiasPercent * 100,
+	}
+}
+
+type PeReport struct {
+	Id         uint32            `json:"id"`
+	Weight     uint32            `json:"weight"`
+	Count      uint32            `json:"count"`
+	MigrateIn  uint32            `json:"migrate_in"`
+	MigrateOut uint32            `json:"migrate_out"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+type MgReport struct {
+	Id         uint32            `json:"id"`
+	Weight     uint32            `json:"weight"`
+	Total      uint32            `json:"total"`
+	MigrateIn  uint32            `json:"migrate_in"`
+	MigrateOut uint32            `json:"migrate_out"`
+	Stat       StatReport        `json:"stat"`
+	Pes        []*PeReport       `json:"pes"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+type DeviceReport struct {
+	Id     uint32      `json:"id"`
+	Weight uint32      `json:"weight"`
+	Total  uint32      `json:"total"`
+	Stat   StatReport  `json:"stat"`
+	Mgs    []*MgReport `json:"mgs"`
+}
+
+func NewDeviceReport(device *straw2.Device) *DeviceReport {
+	device.CalcStat()
+
+	report := &DeviceReport{
+		Id:     device.Id,
+		Weight: device.Weight,
+		Total:  device.Total,
+		Stat:   NewStatReport(&device.Stat),
+		Mgs:    make([]*MgReport, 0, len(device.Mgs)),
+	}
+
+	for _, mg := range device.Mgs {
+		mg_report := &MgReport{
+			Id:         mg.Id,
+			Weight:     mg.Weight,
+			Total:      mg.Total,
+			MigrateIn:  mg.Migrate.MigrateIn,
+			MigrateOut: mg.Migrate.MigrateOut,
+			Stat:       NewStatReport(&mg.Stat),
+			Pes:        make([]*PeReport, 0, len(mg.Pes)),
+			Labels:     mg.Labels,
+		}
+
+		for _, pe := range mg.Pes {
+			mg_report.Pes = append(mg_report.Pes, &PeReport{
+				Id:         pe.Id,
+				Weight:     pe.Weight,
+				Count:      uint32(len(pe.Data)),
+				MigrateIn:  pe.Migrate.MigrateIn,
+				MigrateOut: pe.Migrate.MigrateOut,
+				Labels:     pe.Labels,
+			})
+		}
+		report.Mgs = append(report.Mgs, mg_report)
+	}
+
+	return report
+}
+
+type MigrateReport struct {
+	FromMgId uint32 `json:"from_mg_id"`
+	ToMgId   uint32 `json:"to_mg_id"`
+	Count    uint32 `json:"count"`
+}
+
+func NewMigrateReports(device *straw2.Device) []*MigrateReport {
+	reports := make([]*MigrateReport, 0, len(device.MigrateMatrix))
+	for k, v := range device.MigrateMatrix {
+		reports = append(reports, &MigrateReport{FromMgId: k.FromMgId, ToMgId: k.ToMgId, Count: v})
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].FromMgId != reports[j].FromMgId {
+			return reports[i].FromMgId < reports[j].FromMgId
+		}
+		return reports[i].ToMgId < reports[j].ToMgId
+	})
+	return reports
+}
+
+type ActionReport struct {
+	Index          int               `json:"index"`
+	Name           string            `json:"name"`
+	Branch         string            `json:"branch,omitempty"`
+	Preview        bool              `json:"preview,omitempty"`
+	Params         map[string]uint32 `json:"params"`
+	UseTimeMs      float64           `json:"use_time_ms"`
+	MigrateTotal   uint32            `json:"migrate_total"`
+	MigrateCrossMg uint32            `json:"migrate_cross_mg"`
+	MigrateMatrix  []*MigrateReport  `json:"migrate_matrix"`
+	Timing         *TimingReport     `json:"timing,omitempty"`
+	Device         *DeviceReport     `json:"device"`
+}
+
+func NewActionReport(index int, action Action, old_sbc, new_sbc *straw2.Device, elapsed time.Duration) *ActionReport {
+	report := &ActionReport{
+		Index:     index,
+		Name:      action.Name(),
+		Params:    action.Params(),
+		UseTimeMs: float64(elapsed.Nanoseconds()) / 1e6,
+		Device:    NewDeviceReport(new_sbc),
+	}
+
+	if old_sbc == new_sbc {
+		report.MigrateMatrix = make([]*MigrateReport, 0)
+		return report
+	}
+
+	// The matrix only holds the moves of this action, while the migrate
+	// counters of the MGs and PEs are accumulated and leave with a removed
+	// MG or PE.
+	report.MigrateMatrix = NewMigrateReports(new_sbc)
+	for _, v := range report.MigrateMatrix {
+		report.MigrateTotal += v.Count
+		if v.FromMgId != v.ToMgId {
+			report.MigrateCrossMg += v.Count
+		}
+	}
+
+	return report
+}
+
+// Label names the action in charts and tables, prefixed by the alternative
+// of the branch it ran in.
+func (self *ActionReport) Label() string {
+	name := self.Name
+	if self.Preview {
+		name = "preview:" + name
+	}
+	if len(self.Branch) > 0 {
+		return fmt.Sprintf("%s/%d.%s", self.Branch, self.Index, name)
+	}
+	return fmt.Sprintf("%d.%s", self.Index, name)
+}
+
+type RunReport struct {
+	Version      int               `json:"version"`
+	Lang         string            `json:"lang"`
+	Descriptions map[string]string `json:"descriptions"`
+	ActionsFile  string            `json:"actions_file"`
+	Actions      []*ActionReport   `json:"actions"`
+	Branches     []*BranchReport   `json:"branches,omitempty"`
+	Errors       []*ErrorReport    `json:"errors,omitempty"`
+}
+
+type ErrorReport struct {
+	Index  int    `json:"index"`
+	Name   string `json:"name"`
+	Branch string `json:"branch,omitempty"`
+	Error  string `json:"error"`
+}
+
+func NewRunReport(cfgFileName string, actions *ActionList) *RunReport {
+	report := &RunReport{
+		Version:      ReportVersion,
+		Lang:         currentLang,
+		Descriptions: FieldDescriptions(),
+		ActionsFile:  cfgFileName,
+		Actions:      actions.reports,
+		Branches:     actions.branches,
+	}
+	for _, v := range actions.errors {
+		report.Errors = append(report.Errors, &ErrorReport{Index: v.Index, Name: v.Action, Branch: v.Branch, Error: v.Err.Error()})
+	}
+	return report
+}
+
+func (self *RunReport) Json() string {
+	data, err := json.MarshalIndent(self, "", "  ")
+	if err != nil {
+		fmt.Printf("ERROR: cannot encode json report: %v\n", err)
+		return ""
+	}
+	return string(data) + "\n"
+}
+
+func (self *RunReport) Csv() string {
+	buf := &bytes.Buffer{}
+	writer := csv.NewWriter(buf)
+
+	writer.Write([]string{"index", "action", "branch", "params", "use_time_ms", "level", "mg_id", "pe_id",
+		"weight", "total", "migrate_in", "migrate_out", "average_bias_percent", "max_bias_percent"})
+
+	for _, action := range self.Actions {
+		prefix := []string{fmt.Sprintf("%d", action.Index), action.Name, action.Branch, FormatParams(action.Params),
+			fmt.Sprintf("%.3f", action.UseTimeMs)}
+
+		device := action.Device
+		migrate_in, migrate_out := uint32(0), uint32(0)
+		for _, mg := range device.Mgs {
+			migrate_in += mg.MigrateIn
+			migrate_out += mg.MigrateOut
+		}
+
+		writer.Write(append(prefix, "device", "", "", fmt.Sprintf("%d", device.Weight), fmt.Sprintf("%d", device.Total),
+			fmt.Sprintf("%d", migrate_in), fmt.Sprintf("%d", migrate_out),
+			fmt.Sprintf("%.4f", device.Stat.AverageBiasPercent), fmt.Sprintf("%.4f", device.Stat.MaxBiasPercent)))
+
+		for _, mg := range device.Mgs {
+			writer.Write(append(prefix, "mg", fmt.Sprintf("%d", mg.Id), "", fmt.Sprintf("%d", mg.Weight),
+				fmt.Sprintf("%d", mg.Total), fmt.Sprintf("%d", mg.MigrateIn), fmt.Sprintf("%d", mg.MigrateOut),
+				fmt.Sprintf("%.4f", mg.Stat.AverageBiasPercent), fmt.Sprintf("%.4f", mg.Stat.MaxBiasPercent)))
+
+			for _, pe := range mg.Pes {
+				writer.Write(append(prefix, "pe", fmt.Sprintf("%d", mg.Id), fmt.Sprintf("%d", pe.Id),
+					fmt.Sprintf("%d", pe.Weight), fmt.Sprintf("%d", pe.Count), fmt.Sprintf("%d", pe.MigrateIn),
+					fmt.Sprintf("%d", pe.MigrateOut), "", ""))
+			}
+		}
+	}
+
+	writer.Flush()
+	return buf.String()
+}
+
+func FormatParams(params map[string]uint32) string {
+	names := make([]string, 0, len(params))
+	for name, _ := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	str := make([]string, 0, len(names))
+	for _, name := range names {
+		str = append(str, fmt.Sprintf("%s=%d", name, params[name]))
+	}
+	return strings.Join(str, " ")
+}
+
+func ReplaceExt(filename, ext string) string {
+	filename = strings.TrimSuffix(filename, ".gz")
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + ext
+}
@@ -0,0 +1,443 @@
+package sim
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	FormatCfg  = "cfg"
+	FormatJson = "json"
+	FormatYaml = "yaml"
+)
+
+func ScenarioFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return FormatJson
+	case ".yaml", ".yml":
+		return FormatYaml
+	}
+	return FormatCfg
+}
+
+func scenarioUint32(val interface{}) (uint32, bool) {
+	var f float64
+	switch v := val.(type) {
+	case json.Number:
+		i, err := v.Int64()
+		if err != nil {
+			return 0, false
+		}
+		f = float64(i)
+	case int64:
+		f = float64(v)
+	case float64:
+		f = v
+	default:
+		return 0, false
+	}
+
+	if f < 0 || f > math.MaxUint32 || f != math.Trunc(f) {
+		return 0, false
+	}
+	return uint32(f), true
+}
+
+func LoadScenario(filename string, doc interface{}) (*ActionList, []*ParseError) {
+	return loadScenario(filename, doc, NewParseContext())
+}
+
+func loadScenario(filename string, doc interface{}, ctx *ParseContext) (*ActionList, []*ParseError) {
+	parser := &Parser{filename: filename, ctx: ctx}
+
+	root, ok := doc.(map[string]interface{})
+	if !ok {
+		parser.errorAtNode("", "scenario must be a mapping with an \"actions\" list")
+		return nil, ctx.errors
+	}
+
+	for k, _ := range root {
+		if k != "actions" {
+			parser.errorAtNode(k, "unknown scenario key \"%s\"", k)
+		}
+	}
+
+	list, ok := root["actions"].([]interface{})
+	if !ok {
+		parser.errorAtNode("actions", "scenario must have an \"actions\" list")
+		return nil, ctx.errors
+	}
+
+	parser.loadActions("actions", list)
+
+	if len(ctx.errors) > 0 {
+		return nil, ctx.errors
+	}
+	ctx.actions.warnings = ctx.warnings
+	return ctx.actions, nil
+}
+
+// nodePos returns where the node at path of a YAML scenario starts, or
+// where the closest enclosing node starts if path is inside a flow
+// collection. It returns the zero position for other scenarios.
+func (self *Parser) nodePos(path string) yamlPos {
+	for {
+		if pos, ok := self.ctx.nodes[path]; ok {
+			return pos
+		}
+		index := strings.LastIndexAny(path, ".[")
+		if index < 0 {
+			break
+		}
+		path = path[:index]
+	}
+	return self.ctx.nodes[""]
+}
+
+func (self *Parser) errorAtNode(path string, format string, args ...interface{}) {
+	pos := self.nodePos(path)
+	self.errorAt(pos.line, pos.column, format, args...)
+}
+
+// loadActions adds the actions of list to the action list of the context.
+// path is the path of list in the scenario document.
+func (self *Parser) loadActions(path string, list []interface{}) {
+	for i, v := range list {
+		item := &Parser{filename: self.filename, ctx: self.ctx, node: fmt.Sprintf("%s[%d]", path, i)}
+
+		fields, ok := v.(map[string]interface{})
+		if !ok {
+			item.errorAtNode(item.node, "action must be a mapping")
+			continue
+		}
+
+		name, ok := fields["action"].(string)
+		if !ok {
+			item.errorAtNode(item.node, "missing \"action\" name")
+			continue
+		}
+
+		if name == "expect" {
+			cond, ok := fields["cond"].(string)
+			if !ok || len(fields) != 2 {
+				item.errorAtNode(item.node, "expect needs exactly one string field \"cond\"")
+				continue
+			}
+			expect := &Parser{filename: self.filename + ": " + item.node, lexer: NewLexer("expect: " + cond), ctx: self.ctx}
+			expect.next()
+			expect.parseAll()
+			continue
+		}
+
+		if name == "branch" {
+			item.loadBranch(fields)
+			continue
+		}
+
+		preview := false
+		if v, ok := fields["preview"]; ok {
+			if preview, ok = v.(bool); !ok {
+				item.errorAtNode(item.node+".preview", "\"preview\" must be true or false")
+				continue
+			}
+		}
+
+		name = strings.ToLower(name)
+		spec, ok := LookupAction(name)
+		if !ok {
+			item.errorAtNode(item.node+".action", "unknown action \"%s\"", name)
+			continue
+		}
+
+		keys := make([]string, 0, len(fields))
+		for k, _ := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		valid := true
+		args := NewActionArgs(nil)
+		for _, k := range keys {
+			if k == "action" || k == "preview" {
+				continue
+			}
+			if !item.loadParam(spec, args, item.node+"."+k, strings.ToLower(k), fields[k]) {
+				valid = false
+			}
+		}
+
+		if !valid {
+			continue
+		}
+
+		action, errors := spec.Build(args)
+		for _, err := range errors {
+			item.errorAtNode(item.node, "%v", err)
+		}
+		if len(errors) > 0 {
+			continue
+		}
+		if preview {
+			if !previewable(action) {
+				item.errorAtNode(item.node+".preview", "cannot preview \"%s\"", name)
+				continue
+			}
+			action = &ActionPreview{action: action}
+		}
+		pos := item.nodePos(item.node)
+		item.addAction(action, pos.line, pos.column)
+	}
+}
+
+// loadBranch loads {"action": "branch", "alts": [{"name": ..., "actions": [...]}]}.
+func (self *Parser) loadBranch(fields map[string]interface{}) {
+	list, ok := fields["alts"].([]interface{})
+	if !ok || len(fields) != 2 || len(list) == 0 {
+		self.errorAtNode(self.node, "branch needs exactly one non-empty list field \"alts\"")
+		return
+	}
+
+	branch := &ActionBranch{}
+	names := make(map[string]bool)
+	actions := self.ctx.actions
+	for i, v := range list {
+		alt, ok := v.(map[string]interface{})
+		name, has_name := alt["name"].(string)
+		alt_actions, has_actions := alt["actions"].([]interface{})
+		if !ok || !has_name || !has_actions || len(alt) != 2 {
+			self.errorAtNode(fmt.Sprintf("%s.alts[%d]", self.node, i), "alts[%d] needs a string \"name\" and an \"actions\" list", i)
+			continue
+		}
+		if names[name] {
+			self.errorAtNode(fmt.Sprintf("%s.alts[%d].name", self.node, i), "duplicate alt \"%s\"", name)
+		}
+		names[name] = true
+
+		self.ctx.actions = NewActionList()
+		self.loadActions(fmt.Sprintf("%s.alts[%d].actions", self.node, i), alt_actions)
+		branch.alts = append(branch.alts, &BranchAlt{name: name, actions: self.ctx.actions})
+		self.ctx.actions = actions
+	}
+	self.ctx.actions.Add(branch)
+}
+
+// loadParam loads the parameter name of spec from the node at path.
+func (self *Parser) loadParam(spec *ActionSpec, args *ActionArgs, path, name string, val interface{}) bool {
+	param, ok := spec.Param(name)
+	if !ok {
+		self.errorAtNode(path, "unknown parameter \"%s\" for action \"%s\"", name, spec.Name)
+		return false
+	}
+
+	switch param.Kind {
+	case ParamString:
+		str, ok := val.(string)
+		if !ok {
+			self.errorAtNode(path, "value %v of parameter \"%s\" is not a string", val, name)
+			return false
+		}
+		args.strs[name] = str
+	case ParamTopology:
+		if file, ok := val.(string); ok {
+			pos := self.nodePos(path)
+			topology, ok := self.resolveTopology(&Param{name: name, kind: TokenString, str: file, line: pos.line, column: pos.column})
+			if ok {
+				args.topologies[name] = topology
+			}
+			return ok
+		}
+
+		topology, errors := LoadTopologyDoc(val)
+		for _, err := range errors {
+			self.errorAtNode(path, "%s: %v", name, err)
+		}
+		if len(errors) > 0 {
+			return false
+		}
+		args.topologies[name] = topology
+	default:
+		num, ok := scenarioUint32(val)
+		if !ok {
+			self.errorAtNode(path, "value %v of parameter \"%s\" is not an unsigned 32-bit integer", val, name)
+			return false
+		}
+		if err := param.Check(num); err != nil {
+			self.errorAtNode(path, "%v", err)
+			return false
+		}
+		args.values[name] = num
+	}
+	return true
+}
+
+func ParseScenario(filename, src string) (*ActionList, []*ParseError) {
+	return parseScenario(filename, src, NewParseContext())
+}
+
+// parseScenario parses in ctx, where the variables, topologies and
+// checkpoints of earlier input are known.
+func parseScenario(filename, src string, ctx *ParseContext) (*ActionList, []*ParseError) {
+	var doc interface{}
+	var err error
+
+	switch ScenarioFormat(filename) {
+	case FormatJson:
+		decoder := json.NewDecoder(strings.NewReader(src))
+		decoder.UseNumber()
+		err = decoder.Decode(&doc)
+	case FormatYaml:
+		doc, ctx.nodes, err = parseYaml(src)
+	default:
+		return NewParser(filename, src, ctx).Parse()
+	}
+
+	if err != nil {
+		return nil, []*ParseError{{filename: filename, msg: err.Error()}}
+	}
+	actions, errors := loadScenario(filename, doc, ctx)
+	ctx.nodes = nil
+	return actions, errors
+}
+
+func (self *ActionList) ScenarioItems() []map[string]interface{} {
+	items := make([]map[string]interface{}, 0, len(self.actions))
+	for _, v := range self.actions {
+		item := map[string]interface{}{"action": v.Name()}
+		if expect, ok := v.(*ActionExpect); ok {
+			item["cond"] = expect.cond.String()
+		} else if branch, ok := v.(*ActionBranch); ok {
+			alts := make([]interface{}, 0, len(branch.alts))
+			for _, alt := range branch.alts {
+				alts = append(alts, map[string]interface{}{"name": alt.name, "actions": alt.actions.ScenarioItems()})
+			}
+			item["alts"] = alts
+		} else {
+			if _, ok := v.(*ActionPreview); ok {
+				item["preview"] = true
+			}
+			args := ArgsOf(v)
+			for k, val := range args.values {
+				item[k] = val
+			}
+			for k, val := range args.strs {
+				item[k] = val
+			}
+			for k, topology := range args.topologies {
+				if len(topology.file) > 0 {
+					item[k] = topology.file
+				} else {
+					item[k] = topology.Doc()
+				}
+			}
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func (self *ActionList) Json() string {
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+
+	if err := encoder.Encode(map[string]interface{}{"actions": self.ScenarioItems()}); err != nil {
+		fmt.Printf("ERROR: cannot encode json scenario: %v\n", err)
+		return ""
+	}
+	return buf.String()
+}
+
+func (self *ActionList) Yaml() string {
+	buf := &bytes.Buffer{}
+	buf.WriteString("actions:\n")
+	self.yaml(buf, "  ")
+	return buf.String()
+}
+
+func (self *ActionList) yaml(buf *bytes.Buffer, indent string) {
+	for _, v := range self.actions {
+		fmt.Fprintf(buf, "%s- action: %s\n", indent, v.Name())
+		if expect, ok := v.(*ActionExpect); ok {
+			fmt.Fprintf(buf, "%s  cond: %s\n", indent, YamlQuote(expect.cond.String()))
+			continue
+		}
+
+		if branch, ok := v.(*ActionBranch); ok {
+			fmt.Fprintf(buf, "%s  alts:\n", indent)
+			for _, alt := range branch.alts {
+				fmt.Fprintf(buf, "%s    - name: %s\n", indent, YamlQuote(alt.name))
+				if len(alt.actions.actions) == 0 {
+					fmt.Fprintf(buf, "%s      actions: []\n", indent)
+					continue
+				}
+				fmt.Fprintf(buf, "%s      actions:\n", indent)
+				alt.actions.yaml(buf, indent+"        ")
+			}
+			continue
+		}
+
+		if _, ok := v.(*ActionPreview); ok {
+			fmt.Fprintf(buf, "%s  preview: true\n", indent)
+		}
+
+		spec, ok := LookupAction(v.Name())
+		if !ok {
+			continue
+		}
+		args := ArgsOf(v)
+		for _, param := range spec.Params {
+			if val, ok := args.values[param.Name]; ok {
+				fmt.Fprintf(buf, "%s  %s: %d\n", indent, param.Name, val)
+			} else if val, ok := args.strs[param.Name]; ok {
+				fmt.Fprintf(buf, "%s  %s: %s\n", indent, param.Name, YamlQuote(val))
+			} else if topology, ok := args.topologies[param.Name]; ok && len(topology.file) > 0 {
+				fmt.Fprintf(buf, "%s  %s: %s\n", indent, param.Name, YamlQuote(topology.file))
+			} else if ok {
+				fmt.Fprintf(buf, "%s  %s:\n%s", indent, param.Name, topology.Yaml(indent+"    "))
+			}
+		}
+	}
+}
+
+func (self *ActionList) Cfg() string {
+	buf := &bytes.Buffer{}
+	self.Expand(buf)
+	return buf.String()
+}
+
+func RunConvert(args []string) bool {
+	if len(args) != 2 {
+		fmt.Printf("usage: %s convert <input file> <output file>\n", filepath.Base(os.Args[0]))
+		return false
+	}
+
+	actions := ParseFile(args[0])
+	if actions == nil {
+		fmt.Printf("ERROR: parse file %s failed\n", args[0])
+		return false
+	}
+	for _, v := range actions.warnings {
+		fmt.Printf("WARNING: %s\n", v)
+	}
+
+	str := ""
+	switch ScenarioFormat(args[1]) {
+	case FormatJson:
+		str = actions.Json()
+	case FormatYaml:
+		str = actions.Yaml()
+	default:
+		str = actions.Cfg()
+	}
+
+	OutputToFile(args[1], str)
+	return true
+}
@@ -0,0 +1,464 @@
+package sim
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"straw2"
+)
+
+// Server runs actions on one device for HTTP clients. Actions run one at a
+// time; lookups go through a Placement and do not wait for them. Requests
+// cannot touch files, and variables, topologies and checkpoints carry over
+// from one request to the next.
+type Server struct {
+	mutex       sync.Mutex
+	device      *straw2.Device
+	placement   *straw2.Placement
+	policy      RunPolicy
+	verify      bool
+	model       *MigrationModel
+	ctx         *ParseContext
+	checkpoints map[string]*straw2.Device
+	count       int
+	reports     []*ActionReport
+	errors      []*ErrorReport
+}
+
+func NewServer() *Server {
+	return &Server{placement: straw2.NewPlacement(&straw2.Device{}), ctx: newServeContext()}
+}
+
+func newServeContext() *ParseContext {
+	ctx := NewParseContext()
+	ctx.noFiles = true
+	return ctx
+}
+
+func (self *Server) SetPolicy(policy RunPolicy) {
+	self.policy = policy
+}
+
+func (self *Server) SetVerify(verify bool) {
+	self.verify = verify
+}
+
+type LookupResult struct {
+	Key   uint32 `json:"key"`
+	MgId  uint32 `json:"mg_id"`
+	PeId  uint32 `json:"pe_id"`
+	Error string `json:"error,omitempty"`
+}
+
+type LookupReport struct {
+	Version uint64          `json:"version"`
+	Keys    []*LookupResult `json:"keys"`
+}
+
+type ApplyReport struct {
+	Version uint64          `json:"version"`
+	Actions []*ActionReport `json:"actions"`
+	Errors  []*ErrorReport  `json:"errors,omitempty"`
+	Output  string          `json:"output"`
+}
+
+// Apply runs actions from the current device and keeps the reports. Index
+// of the reports and errors counts every action applied since the server
+// started or was reset.
+func (self *Server) Apply(actions *ActionList, verbosity Verbosity) *ApplyReport {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.apply(actions, verbosity)
+}
+
+// Exec parses src, cfg text or a scenario as told by the extension of
+// filename, after the earlier requests and applies it.
+func (self *Server) Exec(filename, src string, verbosity Verbosity) (*ApplyReport, []*ParseError) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.ctx.actions = NewActionList()
+	self.ctx.errors = nil
+	self.ctx.warnings = nil
+	self.ctx.includes = nil
+	actions, errors := parseScenario(filename, src, self.ctx)
+	if len(errors) > 0 {
+		return nil, errors
+	}
+	return self.apply(actions, verbosity), nil
+}
+
+func (self *Server) apply(actions *ActionList, verbosity Verbosity) *ApplyReport {
+	buf := &bytes.Buffer{}
+	renderer := NewRenderer(verbosity)
+	renderer.AddSink(buf)
+
+	actions.SetPolicy(self.policy)
+	actions.SetVerify(self.verify)
+	actions.model = self.model
+	actions.checkpoints = self.checkpoints
+	device := actions.RunFrom(renderer, self.device)
+	renderer.Close()
+	self.model = actions.model
+	self.checkpoints = actions.checkpoints
+	for name, _ := range self.checkpoints {
+		self.ctx.checkpoints[name] = true
+	}
+
+	report := &ApplyReport{Actions: actions.reports, Output: buf.String()}
+	for _, v := range actions.reports {
+		v.Index += self.count
+	}
+	for _, v := range actions.errors {
+		report.Errors = append(report.Errors, &ErrorReport{Index: v.Index + self.count, Name: v.Action, Branch: v.Branch, Error: v.Err.Error()})
+	}
+	self.count += len(actions.actions)
+	self.reports = append(self.reports, report.Actions...)
+	self.errors = append(self.errors, report.Errors...)
+
+	if device != self.device && device != nil {
+		self.device = device
+		report.Version = self.placement.Publish(device)
+	} else {
+		report.Version = self.placement.Snapshot().Version()
+	}
+	return report
+}
+
+// Reset drops the device and the reports.
+func (self *Server) Reset() uint64 {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.device = nil
+	self.model = nil
+	self.ctx = newServeContext()
+	self.checkpoints = nil
+	self.count = 0
+	self.reports = nil
+	self.errors = nil
+	return self.placement.Publish(&straw2.Device{})
+}
+
+// Handler answers the requests of clients on this host only: the Host of a
+// request and its Origin, if any, must be loopback, which keeps out web
+// pages posting across sites and DNS rebinding.
+func (self *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lookup", self.handleLookup)
+	mux.HandleFunc("/actions", self.handleActions)
+	mux.HandleFunc("/stats", self.handleStats)
+	mux.HandleFunc("/reports", self.handleReports)
+	mux.HandleFunc("/snapshot", self.handleSnapshot)
+	mux.HandleFunc("/reset", self.handleReset)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLoopbackHost(r.Host) {
+			writeError(w, http.StatusForbidden, "host not allowed")
+			return
+		}
+		if origin := r.Header.Get("Origin"); len(origin) > 0 {
+			if u, err := url.Parse(origin); err != nil || !isLoopbackHost(u.Host) {
+				writeError(w, http.StatusForbidden, "origin not allowed")
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+	io.WriteString(w, "\n")
+}
+
+func writeError(w http.ResponseWriter, status int, format string, a ...interface{}) {
+	writeJson(w, status, map[string]string{"error": fmt.Sprintf(format, a...)})
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, "use %s", method)
+		return false
+	}
+	return true
+}
+
+// handleLookup answers GET /lookup?key=N[&key=M...], all keys from the same
+// snapshot.
+func (self *Server) handleLookup(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	keys := r.URL.Query()["key"]
+	if len(keys) == 0 {
+		writeError(w, http.StatusBadRequest, "missing key")
+		return
+	}
+
+	snapshot := self.placement.Snapshot()
+	report := &LookupReport{Version: snapshot.Version(), Keys: make([]*LookupResult, 0, len(keys))}
+	for _, v := range keys {
+		key, err := strconv.ParseUint(v, 0, 32)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad key \"%s\"", v)
+			return
+		}
+
+		result := &LookupResult{Key: uint32(key)}
+		result.MgId, result.PeId, err = snapshot.Select(result.Key)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		report.Keys = append(report.Keys, result)
+	}
+	writeJson(w, http.StatusOK, report)
+}
+
+// handleActions runs the scenario in the body of POST /actions. The body is
+// cfg text, or a json or yaml scenario as told by Content-Type. include,
+// topology files, save:, load:, export_crushmap: and export_plan: are
+// parse errors.
+func (self *Server) handleActions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	verbosity := VerbositySummary
+	if name := r.URL.Query().Get("verbosity"); len(name) > 0 {
+		var ok bool
+		if verbosity, ok = ParseVerbosity(name); !ok {
+			writeError(w, http.StatusBadRequest, "unknown verbosity \"%s\"", name)
+			return
+		}
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "cannot read body: %v", err)
+		return
+	}
+
+	filename := "request.cfg"
+	content_type := r.Header.Get("Content-Type")
+	if strings.Contains(content_type, "json") {
+		filename = "request.json"
+	} else if strings.Contains(content_type, "yaml") {
+		filename = "request.yaml"
+	}
+
+	report, errors := self.Exec(filename, string(body), verbosity)
+	if len(errors) > 0 {
+		msgs := make([]string, 0, len(errors))
+		for _, v := range errors {
+			msgs = append(msgs, v.Error())
+		}
+		writeJson(w, http.StatusBadRequest, map[string]interface{}{"error": "parse failed", "errors": msgs})
+		return
+	}
+
+	status := http.StatusOK
+	if len(report.Errors) > 0 {
+		status = http.StatusConflict
+	}
+	writeJson(w, status, report)
+}
+
+func (self *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.device == nil {
+		writeError(w, http.StatusConflict, "%v", ErrNoDevice)
+		return
+	}
+	writeJson(w, http.StatusOK, NewDeviceReport(self.device))
+}
+
+// handleReports answers GET /reports[?since=N] with the reports of the
+// actions after the Nth.
+func (self *Server) handleReports(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	since := 0
+	if v := r.URL.Query().Get("since"); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "bad since \"%s\"", v)
+			return
+		}
+		since = n
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	report := &RunReport{
+		Version:      ReportVersion,
+		Lang:         currentLang,
+		Descriptions: FieldDescriptions(),
+		Actions:      make([]*ActionReport, 0),
+	}
+	for _, v := range self.reports {
+		if v.Index > since {
+			report.Actions = append(report.Actions, v)
+		}
+	}
+	for _, v := range self.errors {
+		if v.Index > since {
+			report.Errors = append(report.Errors, v)
+		}
+	}
+	writeJson(w, http.StatusOK, report)
+}
+
+// handleSnapshot answers GET /snapshot[?format=state|crushmap] with the
+// device as a state file for load: or -load-state, or as a crushmap.
+func (self *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.device == nil {
+		writeError(w, http.StatusConflict, "%v", ErrNoDevice)
+		return
+	}
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "state":
+		buf := &bytes.Buffer{}
+		if err := SaveState(buf, self.device); err != nil {
+			writeError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"straw2.state\"")
+		w.Write(buf.Bytes())
+	case "crushmap":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"crushmap.txt\"")
+		io.WriteString(w, FormatCrushMap(self.device))
+	default:
+		writeError(w, http.StatusBadRequest, "unknown format \"%s\"", format)
+	}
+}
+
+func (self *Server) handleReset(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]uint64{"version": self.Reset()})
+}
+
+// IsLoopback reports whether addr, a host:port, only listens on this host.
+func IsLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	return isLoopbackHost(host)
+}
+
+// isLoopbackHost reports whether host, with or without a port, names this
+// host.
+func isLoopbackHost(host string) bool {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// RunServe runs "serve": it optionally runs an actions file or loads a
+// state, then answers HTTP requests on localhost until it fails.
+func RunServe(args []string) bool {
+	flags := flag.NewFlagSet(filepath.Base(os.Args[0])+" serve", flag.ExitOnError)
+	addr := flags.String("addr", "127.0.0.1:8080", "address to listen on, on localhost")
+	actionsFileName := flags.String("actions", "", "actions file run before serving")
+	loadStateFileName := flags.String("load-state", "", "state file loaded before serving")
+	lang := flags.String("lang", LangEn, "report language: "+strings.Join(Langs(), "|"))
+	onError := flags.String("on-error", "stop", "what to do when an action fails: stop|continue")
+	verify := flags.Bool("verify", false, "verify the device invariants after every action")
+	flags.Parse(args)
+
+	if !IsLoopback(*addr) {
+		fmt.Printf("ERROR: serve only listens on localhost, not \"%s\"\n", *addr)
+		return false
+	}
+	if !SetLang(*lang) {
+		fmt.Printf("ERROR: unknown language \"%s\"\n", *lang)
+		return false
+	}
+	policy, ok := ParsePolicy(*onError)
+	if !ok {
+		fmt.Printf("ERROR: unknown error policy \"%s\"\n", *onError)
+		return false
+	}
+
+	server := NewServer()
+	server.SetPolicy(policy)
+	server.SetVerify(*verify)
+
+	actions := NewActionList()
+	if len(*loadStateFileName) > 0 {
+		device, err := LoadStateFile(*loadStateFileName)
+		if err != nil {
+			fmt.Printf("ERROR: cannot load state: %v\n", err)
+			return false
+		}
+		actions.Add(&ActionLoad{file: *loadStateFileName, device: device})
+	}
+	if len(*actionsFileName) > 0 {
+		list := ParseFile(*actionsFileName)
+		if list == nil {
+			fmt.Printf("ERROR: parse file %s failed\n", *actionsFileName)
+			return false
+		}
+		actions.actions = append(actions.actions, list.actions...)
+		actions.warnings = list.warnings
+	}
+	if len(actions.actions) > 0 {
+		report := server.Apply(actions, VerbositySummary)
+		fmt.Print(report.Output)
+		if len(report.Errors) > 0 {
+			return false
+		}
+	}
+
+	fmt.Printf("serving on http://%s\n", *addr)
+	if err := http.ListenAndServe(*addr, server.Handler()); err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		return false
+	}
+	return true
+}
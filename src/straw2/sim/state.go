@@ -0,0 +1,404 @@
+package sim
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+
+	"straw2"
+)
+
+// A state file is the magic, the format version, the device encoded with
+// unsigned varints and a CRC32 (IEEE) of everything before it. Keys of every
+// PE are sorted and delta encoded. Buckets are stored as they are rather
+// than rebuilt from the PEs, so a loaded device selects exactly like the
+// saved one.
+
+const stateMagic = "S2ST"
+
+const StateVersion = 1
+
+type stateWriter struct {
+	w   *bufio.Writer
+	buf []byte
+	err error
+}
+
+func (self *stateWriter) uvarint(v uint64) {
+	if self.err != nil {
+		return
+	}
+	n := binary.PutUvarint(self.buf, v)
+	_, self.err = self.w.Write(self.buf[:n])
+}
+
+// raw writes s without its length.
+func (self *stateWriter) raw(s string) {
+	if self.err == nil {
+		_, self.err = self.w.WriteString(s)
+	}
+}
+
+func (self *stateWriter) str(s string) {
+	self.uvarint(uint64(len(s)))
+	self.raw(s)
+}
+
+func (self *stateWriter) labels(labels map[string]string) {
+	keys := make([]string, 0, len(labels))
+	for k, _ := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	self.uvarint(uint64(len(keys)))
+	for _, k := range keys {
+		self.str(k)
+		self.str(labels[k])
+	}
+}
+
+func (self *stateWriter) bucket(bucket *straw2.Bucket) {
+	self.uvarint(uint64(bucket.Weight))
+	self.uvarint(uint64(len(bucket.Items)))
+	for _, v := range bucket.Items {
+		self.uvarint(uint64(v.Id))
+		self.uvarint(uint64(v.Weight))
+	}
+}
+
+func (self *stateWriter) migrate(migrate *straw2.MigrateStat) {
+	self.uvarint(uint64(migrate.MigrateIn))
+	self.uvarint(uint64(migrate.MigrateOut))
+}
+
+func SaveState(w io.Writer, device *straw2.Device) error {
+	crc := crc32.NewIEEE()
+	writer := &stateWriter{w: bufio.NewWriter(io.MultiWriter(w, crc)), buf: make([]byte, binary.MaxVarintLen64)}
+
+	writer.raw(stateMagic)
+	writer.uvarint(StateVersion)
+
+	writer.uvarint(uint64(device.Id))
+	writer.uvarint(uint64(device.Weight))
+	writer.uvarint(uint64(device.Total))
+	writer.bucket(&device.MgBucket)
+	writer.uvarint(uint64(len(device.Mgs)))
+	for _, mg := range device.Mgs {
+		writer.uvarint(uint64(mg.Id))
+		writer.uvarint(uint64(mg.Weight))
+		writer.uvarint(uint64(mg.Total))
+		writer.migrate(&mg.Migrate)
+		writer.labels(mg.Labels)
+		writer.bucket(&mg.PeBucket)
+
+		writer.uvarint(uint64(len(mg.Pes)))
+		for _, pe := range mg.Pes {
+			writer.uvarint(uint64(pe.Id))
+			writer.uvarint(uint64(pe.Weight))
+			writer.migrate(&pe.Migrate)
+			writer.labels(pe.Labels)
+
+			keys := make([]uint32, 0, len(pe.Data))
+			for k, _ := range pe.Data {
+				keys = append(keys, k)
+			}
+			sort.Slice(keys, func(i, j int) bool {
+				return keys[i] < keys[j]
+			})
+
+			writer.uvarint(uint64(len(keys)))
+			last := uint32(0)
+			for _, k := range keys {
+				writer.uvarint(uint64(k - last))
+				last = k
+			}
+		}
+	}
+
+	if writer.err != nil {
+		return writer.err
+	}
+	if err := writer.w.Flush(); err != nil {
+		return err
+	}
+
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc.Sum32())
+	_, err := w.Write(sum)
+	return err
+}
+
+type stateReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (self *stateReader) uvarint() uint64 {
+	if self.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(self.data[self.pos:])
+	if n <= 0 {
+		self.err = fmt.Errorf("state is truncated or corrupt at offset %d", self.pos)
+		return 0
+	}
+	self.pos += n
+	return v
+}
+
+func (self *stateReader) uint32() uint32 {
+	v := self.uvarint()
+	if v > 0xffffffff && self.err == nil {
+		self.err = fmt.Errorf("value %d at offset %d is out of range", v, self.pos)
+	}
+	return uint32(v)
+}
+
+// count reads a length and checks it against the bytes left, so a corrupt
+// length cannot make the reader allocate without bound.
+func (self *stateReader) count() int {
+	v := self.uvarint()
+	if self.err == nil && v > uint64(len(self.data)-self.pos) {
+		self.err = fmt.Errorf("length %d at offset %d is larger than the state", v, self.pos)
+	}
+	if self.err != nil {
+		return 0
+	}
+	return int(v)
+}
+
+func (self *stateReader) str() string {
+	n := self.count()
+	if self.err != nil {
+		return ""
+	}
+	s := string(self.data[self.pos : self.pos+n])
+	self.pos += n
+	return s
+}
+
+func (self *stateReader) labels() map[string]string {
+	n := self.count()
+	if n == 0 {
+		return nil
+	}
+
+	labels := make(map[string]string, n)
+	for i := 0; i < n && self.err == nil; i++ {
+		k := self.str()
+		labels[k] = self.str()
+	}
+	return labels
+}
+
+func (self *stateReader) bucket(bucket *straw2.Bucket) {
+	bucket.Weight = self.uint32()
+	n := self.count()
+	bucket.Items = make([]straw2.Item, 0, n)
+	for i := 0; i < n && self.err == nil; i++ {
+		id := self.uint32()
+		bucket.Items = append(bucket.Items, straw2.Item{Id: id, Weight: self.uint32()})
+	}
+}
+
+func (self *stateReader) migrate(migrate *straw2.MigrateStat) {
+	migrate.MigrateIn = self.uint32()
+	migrate.MigrateOut = self.uint32()
+}
+
+func LoadState(data []byte) (*straw2.Device, error) {
+	if len(data) < len(stateMagic)+4 || string(data[:len(stateMagic)]) != stateMagic {
+		return nil, fmt.Errorf("not a state file")
+	}
+
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return nil, fmt.Errorf("state checksum mismatch")
+	}
+
+	reader := &stateReader{data: body, pos: len(stateMagic)}
+	if version := reader.uvarint(); reader.err == nil && version != StateVersion {
+		return nil, fmt.Errorf("unsupported state version %d, expected %d", version, StateVersion)
+	}
+
+	device := &straw2.Device{}
+	device.Id = reader.uint32()
+	device.Weight = reader.uint32()
+	device.Total = reader.uint32()
+	reader.bucket(&device.MgBucket)
+
+	mg_num := reader.count()
+	for i := 0; i < mg_num && reader.err == nil; i++ {
+		mg := &straw2.MG{}
+		mg.Id = reader.uint32()
+		mg.Weight = reader.uint32()
+		mg.Total = reader.uint32()
+		reader.migrate(&mg.Migrate)
+		mg.Labels = reader.labels()
+		reader.bucket(&mg.PeBucket)
+
+		pe_num := reader.count()
+		for j := 0; j < pe_num && reader.err == nil; j++ {
+			pe := &straw2.PE{}
+			pe.Id = reader.uint32()
+			pe.Weight = reader.uint32()
+			reader.migrate(&pe.Migrate)
+			pe.Labels = reader.labels()
+
+			key_num := reader.count()
+			pe.Data = make(map[uint32]uint32, key_num)
+			key := uint64(0)
+			for k := 0; k < key_num && reader.err == nil; k++ {
+				key += reader.uvarint()
+				pe.Data[uint32(key)] = uint32(key)
+			}
+			if key > 0xffffffff && reader.err == nil {
+				reader.err = fmt.Errorf("key of MG[%d] PE[%d] is out of range", mg.Id, pe.Id)
+			}
+			mg.Pes = append(mg.Pes, pe)
+		}
+		device.Mgs = append(device.Mgs, mg)
+	}
+
+	if reader.err != nil {
+		return nil, reader.err
+	}
+	if reader.pos != len(body) {
+		return nil, fmt.Errorf("%d trailing bytes in state", len(body)-reader.pos)
+	}
+	// The checksum only shows the file is as written, check the device
+	// too in case it was not written by SaveState.
+	if err := VerifyDevice(device); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+func SaveStateFile(filename string, device *straw2.Device) error {
+	buf := &bytes.Buffer{}
+	if err := SaveState(buf, device); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, buf.Bytes(), 0644)
+}
+
+func LoadStateFile(filename string) (*straw2.Device, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	device, err := LoadState(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return device, nil
+}
+
+type ActionSave struct {
+	file string
+}
+
+func NewActionSave(args *ActionArgs) (Action, error) {
+	if len(args.strs["file"]) == 0 {
+		return nil, fmt.Errorf("save needs a file name")
+	}
+	return &ActionSave{file: args.strs["file"]}, nil
+}
+
+func (self *ActionSave) Run(sbc *straw2.Device) (*straw2.Device, error) {
+	if sbc == nil {
+		return nil, ErrNoDevice
+	}
+	if err := SaveStateFile(self.file, sbc); err != nil {
+		return sbc, err
+	}
+	return sbc, nil
+}
+
+func (self *ActionSave) Params() map[string]uint32 {
+	return map[string]uint32{}
+}
+
+func (self *ActionSave) Args() *ActionArgs {
+	args := NewActionArgs(nil)
+	args.strs["file"] = self.file
+	return args
+}
+
+func (self *ActionSave) Name() string {
+	return "save"
+}
+
+func (self *ActionSave) Enter() string {
+	str := fmt.Sprintf("---------------------------------------------------------------------\n")
+	str += fmt.Sprintf(Msg("enter_save"), self.file)
+	str += fmt.Sprintf("---------------------------------------------------------------------\n")
+	return str
+}
+
+// touchesFiles reports whether action reads or writes a file when it runs.
+func touchesFiles(action Action) bool {
+	if preview, ok := action.(*ActionPreview); ok {
+		action = preview.action
+	}
+	switch action.(type) {
+	case *ActionSave, *ActionLoad, *ActionExportCrushMap, *ActionExportPlan:
+		return true
+	}
+	return false
+}
+
+// ActionLoad reads file when it runs, unless the state was already loaded
+// by -load-state.
+type ActionLoad struct {
+	file   string
+	device *straw2.Device
+}
+
+func NewActionLoad(args *ActionArgs) (Action, error) {
+	if len(args.strs["file"]) == 0 {
+		return nil, fmt.Errorf("load needs a file name")
+	}
+	return &ActionLoad{file: args.strs["file"]}, nil
+}
+
+func (self *ActionLoad) Run(sbc *straw2.Device) (*straw2.Device, error) {
+	if self.device != nil {
+		return self.device.Clone(), nil
+	}
+
+	device, err := LoadStateFile(self.file)
+	if err != nil {
+		return sbc, err
+	}
+	return device, nil
+}
+
+func (self *ActionLoad) Params() map[string]uint32 {
+	return map[string]uint32{}
+}
+
+func (self *ActionLoad) Args() *ActionArgs {
+	args := NewActionArgs(nil)
+	args.strs["file"] = self.file
+	return args
+}
+
+func (self *ActionLoad) Name() string {
+	return "load"
+}
+
+func (self *ActionLoad) Enter() string {
+	str := fmt.Sprintf("---------------------------------------------------------------------\n")
+	str += fmt.Sprintf(Msg("enter_load"), self.file)
+	str += fmt.Sprintf("---------------------------------------------------------------------\n")
+	return str
+}
@@ -0,0 +1,133 @@
+package sim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"testing"
+
+	"straw2"
+)
+
+const stateTestKeys = 20000
+
+func stateTestDevice(t *testing.T) *straw2.Device {
+	device := straw2.NewDevice(4, 8, 2)
+	for key := uint32(0); key < stateTestKeys; key++ {
+		mg_id, pe_id, err := device.Select(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := device.AddDataById(mg_id, pe_id, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	device, err := device.ScaleOutMg(9, 8, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.Mgs[0].Labels = map[string]string{"rack": "r1"}
+	return device
+}
+
+func saveState(t *testing.T, device *straw2.Device) []byte {
+	buf := &bytes.Buffer{}
+	if err := SaveState(buf, device); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withChecksum appends the checksum of body, as a tool writing its own
+// state file would.
+func withChecksum(body []byte) []byte {
+	return binary.BigEndian.AppendUint32(append([]byte{}, body...), crc32.ChecksumIEEE(body))
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	device := stateTestDevice(t)
+	loaded, err := LoadState(saveState(t, device))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.Total != device.Total || loaded.Weight != device.Weight || loaded.Size() != device.Size() {
+		t.Fatalf("loaded total %d weight %d mgs %d, want %d %d %d",
+			loaded.Total, loaded.Weight, loaded.Size(), device.Total, device.Weight, device.Size())
+	}
+	if loaded.Mgs[0].Labels["rack"] != "r1" {
+		t.Fatalf("labels of MG[%d] are %v", loaded.Mgs[0].Id, loaded.Mgs[0].Labels)
+	}
+	for key := uint32(0); key < stateTestKeys; key++ {
+		mg_id, pe_id, err := device.Select(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded_mg_id, loaded_pe_id, err := loaded.Select(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded_mg_id != mg_id || loaded_pe_id != pe_id {
+			t.Fatalf("key %d on MG[%d] PE[%d] after load, want MG[%d] PE[%d]", key, loaded_mg_id, loaded_pe_id, mg_id, pe_id)
+		}
+	}
+	if !bytes.Equal(saveState(t, loaded), saveState(t, device)) {
+		t.Fatal("saving the loaded device gives another state")
+	}
+}
+
+func TestStateTruncated(t *testing.T) {
+	data := saveState(t, stateTestDevice(t))
+	for _, n := range []int{0, 1, len(stateMagic), len(stateMagic) + 4, len(data) / 2, len(data) - 5, len(data) - 1} {
+		if _, err := LoadState(data[:n]); err == nil {
+			t.Errorf("state truncated to %d of %d bytes loaded", n, len(data))
+		}
+		if n > len(data)-4 {
+			continue
+		}
+		if _, err := LoadState(withChecksum(data[:n])); err == nil {
+			t.Errorf("state truncated to %d of %d bytes with a checksum loaded", n, len(data))
+		}
+	}
+}
+
+func TestStateCorrupt(t *testing.T) {
+	data := saveState(t, stateTestDevice(t))
+	for _, i := range []int{0, len(stateMagic), len(data) / 2, len(data) - 1} {
+		corrupt := append([]byte{}, data...)
+		corrupt[i] ^= 0x40
+		if _, err := LoadState(corrupt); err == nil {
+			t.Errorf("state with byte %d of %d changed loaded", i, len(data))
+		}
+	}
+}
+
+func TestStateInconsistent(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(device *straw2.Device)
+	}{
+		{"total", func(device *straw2.Device) {
+			device.Total++
+		}},
+		{"bucket", func(device *straw2.Device) {
+			device.Mgs[1].PeBucket.Items[0].Weight++
+		}},
+		{"key twice", func(device *straw2.Device) {
+			for key, _ := range device.Mgs[0].Pes[0].Data {
+				device.Mgs[0].Pes[1].Data[key] = key
+				break
+			}
+		}},
+	}
+
+	for _, test := range tests {
+		device := stateTestDevice(t)
+		test.change(device)
+		_, err := LoadState(saveState(t, device))
+		if !errors.Is(err, straw2.ErrInconsistent) {
+			t.Errorf("%s: loading gives %v, want %v", test.name, err, straw2.ErrInconsistent)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package sim
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SweepParam struct {
+	name   string
+	values []uint32
+}
+
+func (self *SweepParam) String() string {
+	str := fmt.Sprintf("%s = ", self.name)
+	for i, v := range self.values {
+		if i > 0 {
+			str += ","
+		}
+		str += fmt.Sprintf("%d", v)
+	}
+	return str
+}
+
+type SweepResult struct {
+	values       []uint32
+	index        int
+	name         string
+	total        uint32
+	migrate      uint32
+	crossMg      uint32
+	mgAvgBiasPct float64
+	mgMaxBiasPct float64
+	peMaxBiasPct float64
+	elapsed      time.Duration
+}
+
+type Sweep struct {
+	params []*SweepParam
+}
+
+func NewSweep() *Sweep {
+	return &Sweep{params: make([]*SweepParam, 0)}
+}
+
+func (self *Sweep) Add(param *SweepParam) {
+	self.params = append(self.params, param)
+}
+
+func (self *Sweep) Combinations() [][]uint32 {
+	combinations := [][]uint32{{}}
+	for _, param := range self.params {
+		next := make([][]uint32, 0, len(combinations)*len(param.values))
+		for _, c := range combinations {
+			for _, v := range param.values {
+				values := make([]uint32, len(c), len(c)+1)
+				copy(values, c)
+				next = append(next, append(values, v))
+			}
+		}
+		combinations = next
+	}
+	return combinations
+}
+
+// Apply returns actions with the parameters of every power_on set to
+// values, and the errors of the power_on actions they make invalid.
+func (self *Sweep) Apply(actions *ActionList, values []uint32) (*ActionList, []error) {
+	new_actions := NewActionList()
+	errors := make([]error, 0)
+	new_actions.SetPolicy(actions.policy)
+	new_actions.SetVerify(actions.verify)
+	new_actions.SetDryRun(actions.dryRun)
+	for _, v := range actions.actions {
+		if branch, ok := v.(*ActionBranch); ok {
+			new_branch := &ActionBranch{alts: make([]*BranchAlt, 0, len(branch.alts))}
+			for _, alt := range branch.alts {
+				alt_actions, alt_errors := self.Apply(alt.actions, values)
+				new_branch.alts = append(new_branch.alts, &BranchAlt{name: alt.name, actions: alt_actions})
+				errors = append(errors, alt_errors...)
+			}
+			new_actions.Add(new_branch)
+			continue
+		}
+
+		if _, ok := v.(*ActionPreview); ok || v.Name() != "power_on" {
+			new_actions.Add(v)
+			continue
+		}
+
+		args := ArgsOf(v)
+		for i, param := range self.params {
+			args.values[param.name] = values[i]
+		}
+
+		action, action_errors := NewAction(v.Name(), args)
+		if len(action_errors) > 0 {
+			errors = append(errors, action_errors...)
+			continue
+		}
+		new_actions.Add(action)
+	}
+	return new_actions, errors
+}
+
+// Check returns an error for every combination that makes a power_on of
+// actions invalid, so a sweep fails before it runs anything.
+func (self *Sweep) Check(actions *ActionList) []error {
+	errors := make([]error, 0)
+	for _, values := range self.Combinations() {
+		_, apply_errors := self.Apply(actions, values)
+		for _, err := range apply_errors {
+			errors = append(errors, fmt.Errorf("sweep %s: %w", self.PrintValues(values), err))
+		}
+	}
+	return errors
+}
+
+// RunOne runs actions without any output and returns a result for every
+// action that changed the device.
+func (self *Sweep) RunOne(actions *ActionList, values []uint32) []*SweepResult {
+	actions.Run(NewRenderer(VerbositySummary))
+
+	results := make([]*SweepResult, 0, len(actions.reports))
+	for _, report := range actions.reports {
+		name := report.Name
+		if len(report.Branch) > 0 {
+			name = report.Branch + "/" + name
+		}
+
+		pe_max_bias := float64(0)
+		for _, mg := range report.Device.Mgs {
+			if mg.Stat.MaxBiasPercent > pe_max_bias {
+				pe_max_bias = mg.Stat.MaxBiasPercent
+			}
+		}
+
+		results = append(results, &SweepResult{
+			values:       values,
+			index:        report.Index,
+			name:         name,
+			total:        report.Device.Total,
+			migrate:      report.MigrateTotal,
+			crossMg:      report.MigrateCrossMg,
+			mgAvgBiasPct: report.Device.Stat.AverageBiasPercent,
+			mgMaxBiasPct: report.Device.Stat.MaxBiasPercent,
+			peMaxBiasPct: pe_max_bias,
+			elapsed:      time.Duration(report.UseTimeMs * 1e6),
+		})
+	}
+	return results
+}
+
+// Run runs actions for every combination and returns the table of
+// results. It stops at the first combination that makes a power_on invalid.
+func (self *Sweep) Run(actions *ActionList) (string, error) {
+	combinations := self.Combinations()
+
+	str := self.PrintHeader()
+	for i, values := range combinations {
+		fmt.Printf("sweep [%d/%d]: %s\n", i+1, len(combinations), self.PrintValues(values))
+		applied, errors := self.Apply(actions, values)
+		if len(errors) > 0 {
+			return str, fmt.Errorf("sweep %s: %w", self.PrintValues(values), errors[0])
+		}
+		for _, result := range self.RunOne(applied, values) {
+			str += self.PrintResult(result)
+		}
+		for _, err := range applied.Errors() {
+			fmt.Printf("ERROR: %v\n", err)
+		}
+	}
+	return str, nil
+}
+
+func (self *Sweep) PrintValues(values []uint32) string {
+	str := ""
+	for i, param := range self.params {
+		if i > 0 {
+			str += ", "
+		}
+		str += fmt.Sprintf("%s = %d", param.name, values[i])
+	}
+	return str
+}
+
+func (self *Sweep) PrintHeader() string {
+	str := ""
+	for _, param := range self.params {
+		str += fmt.Sprintf("%10s ", param.name)
+	}
+	str += fmt.Sprintf("%4s %-10s %10s %10s %9s %10s %13s %13s %13s %12s\n",
+		"step", "action", "total", "migrate", "migrate%", "cross_mg",
+		"mg_avg_bias%", "mg_max_bias%", "pe_max_bias%", "use_time")
+	return str
+}
+
+func (self *Sweep) PrintResult(result *SweepResult) string {
+	str := ""
+	for _, v := range result.values {
+		str += fmt.Sprintf("%10d ", v)
+	}
+
+	migrate_percent := float64(0)
+	if result.total > 0 {
+		migrate_percent = float64(result.migrate) / float64(result.total) * 100
+	}
+
+	str += fmt.Sprintf("%4d %-10s %10d %10d %8.2f%% %10d %12.2f%% %12.2f%% %12.2f%% %12v\n",
+		result.index, result.name, result.total, result.migrate, migrate_percent, result.crossMg,
+		result.mgAvgBiasPct, result.mgMaxBiasPct,
+		result.peMaxBiasPct, result.elapsed.Round(time.Millisecond))
+	return str
+}
+
+func ParseSweepValues(str string) ([]uint32, bool) {
+	str = strings.TrimSpace(str)
+	if len(str) == 0 {
+		return nil, false
+	}
+
+	if range_end := strings.Index(str, ".."); range_end >= 0 {
+		begin, err := strconv.ParseUint(strings.TrimSpace(str[:range_end]), 10, 32)
+		if err != nil {
+			return nil, false
+		}
+
+		line_left := strings.TrimSpace(str[range_end+2:])
+		step := uint64(1)
+		if step_begin := strings.Index(line_left, "step"); step_begin >= 0 {
+			step, err = strconv.ParseUint(strings.TrimSpace(line_left[step_begin+len("step"):]), 10, 32)
+			if err != nil || step == 0 {
+				return nil, false
+			}
+			line_left = strings.TrimSpace(line_left[:step_begin])
+		}
+
+		end, err := strconv.ParseUint(line_left, 10, 32)
+		if err != nil || end < begin {
+			return nil, false
+		}
+
+		values := make([]uint32, 0)
+		for v := begin; v <= end; v += step {
+			values = append(values, uint32(v))
+		}
+		return values, true
+	}
+
+	values := make([]uint32, 0)
+	for _, v := range strings.Split(str, ",") {
+		val, err := strconv.ParseUint(strings.TrimSpace(v), 10, 32)
+		if err != nil {
+			return nil, false
+		}
+		values = append(values, uint32(val))
+	}
+	return values, true
+}
+
+func ParseSweepLine(line string) (*SweepParam, bool) {
+	line = strings.ToLower(line)
+	name_end := strings.Index(line, "=")
+	if name_end < 0 {
+		return nil, false
+	}
+
+	param := &SweepParam{name: strings.TrimSpace(line[:name_end])}
+	spec, _ := LookupAction("power_on")
+	param_spec, ok := spec.Param(param.name)
+	if !ok || param_spec.Kind != ParamUint32 {
+		return nil, false
+	}
+
+	values, ok := ParseSweepValues(line[name_end+1:])
+	if !ok {
+		return nil, false
+	}
+
+	for _, v := range values {
+		if param_spec.Check(v) != nil {
+			return nil, false
+		}
+	}
+
+	param.values = values
+	return param, true
+}
+
+func ParseSweepFile(filename string) *Sweep {
+	sweep := NewSweep()
+
+	file, err := os.Open(filename)
+	if err != nil {
+		fmt.Printf("ERROR: cannot open file %s\n", filename)
+		return nil
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && io.EOF != err {
+			break
+		}
+
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			if io.EOF == err {
+				break
+			}
+			continue
+		}
+
+		param, ok := ParseSweepLine(line)
+		if !ok {
+			fmt.Printf("ERROR: parse sweep line failed: %s\n", line)
+			return nil
+		}
+		sweep.Add(param)
+
+		if io.EOF == err {
+			break
+		}
+	}
+
+	return sweep
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package sim
+
+import "errors"
+
+// makeRaw is only implemented for linux. Elsewhere the line editor reads
+// whole lines without completion.
+func makeRaw(fd int) (func(), error) {
+	return nil, errors.New("raw terminal not supported")
+}
@@ -0,0 +1,247 @@
+package sim
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"straw2"
+)
+
+// ProgressSteps is how many points the progress curve has when the model
+// does not set a step.
+const ProgressSteps = 20
+
+// MigrationModel turns the moves of an action into a duration. Every key
+// has the same size. A move reads from one PE and writes to another, each
+// PE shares its bandwidth between the moves it takes part in, and takes
+// part in at most MaxBackfills moves at once. Moves between MGs also share
+// the network bandwidth of both MGs.
+type MigrationModel struct {
+	KeySize      uint32 // KiB
+	PeBandwidth  uint32 // MiB/s
+	MgBandwidth  uint32 // MiB/s, 0 for no limit
+	MaxBackfills uint32
+	Step         uint32 // seconds, 0 for ProgressSteps points
+}
+
+type ProgressPoint struct {
+	Seconds float64 `json:"seconds"`
+	Moved   int     `json:"moved"`
+	Percent float64 `json:"percent"`
+}
+
+type TimingReport struct {
+	Seconds        float64          `json:"seconds"`
+	Moves          int              `json:"moves"`
+	Bytes          uint64           `json:"bytes"`
+	BusiestMgId    uint32           `json:"busiest_mg_id"`
+	BusiestPeId    uint32           `json:"busiest_pe_id"`
+	BusiestSeconds float64          `json:"busiest_seconds"`
+	BusiestMoves   int              `json:"busiest_moves"`
+	Progress       []*ProgressPoint `json:"progress"`
+}
+
+type peRef struct {
+	mg_id uint32
+	pe_id uint32
+}
+
+type transfer struct {
+	from      peRef
+	to        peRef
+	cross     bool
+	remaining float64
+}
+
+// SimulateMigration runs moves in their order, each as soon as both of its
+// PEs have a free backfill slot, and returns when they are all done.
+func SimulateMigration(moves []straw2.Move, model *MigrationModel) *TimingReport {
+	report := &TimingReport{Moves: len(moves), Bytes: uint64(len(moves)) * uint64(model.KeySize) * 1024, Progress: make([]*ProgressPoint, 0)}
+	if len(moves) == 0 {
+		return report
+	}
+
+	size := float64(model.KeySize) * 1024
+	pe_bandwidth := float64(model.PeBandwidth) * 1024 * 1024
+	mg_bandwidth := float64(model.MgBandwidth) * 1024 * 1024
+	max_backfills := int(model.MaxBackfills)
+
+	// pending holds, per PE, the moves it takes part in, in plan order;
+	// heads skip the ones already started.
+	pending := make(map[peRef][]int)
+	heads := make(map[peRef]int)
+	for i, v := range moves {
+		from, to := peRef{v.FromMgId, v.FromPeId}, peRef{v.ToMgId, v.ToPeId}
+		pending[from] = append(pending[from], i)
+		pending[to] = append(pending[to], i)
+	}
+
+	started := make([]bool, len(moves))
+	active := make(map[peRef]int)
+	mg_active := make(map[uint32]int)
+	counts := make(map[peRef]int)
+	busy := make(map[peRef]float64)
+	running := make([]*transfer, 0)
+	done := make([]float64, 0, len(moves))
+
+	start := func(index int) bool {
+		v := moves[index]
+		from, to := peRef{v.FromMgId, v.FromPeId}, peRef{v.ToMgId, v.ToPeId}
+		if started[index] || active[from] >= max_backfills || active[to] >= max_backfills {
+			return false
+		}
+		started[index] = true
+		active[from]++
+		active[to]++
+		counts[from]++
+		counts[to]++
+		t := &transfer{from: from, to: to, cross: v.FromMgId != v.ToMgId, remaining: size}
+		if t.cross {
+			mg_active[v.FromMgId]++
+			mg_active[v.ToMgId]++
+		}
+		running = append(running, t)
+		return true
+	}
+
+	fill := func(pe peRef) {
+		list := pending[pe]
+		for heads[pe] < len(list) && started[list[heads[pe]]] {
+			heads[pe]++
+		}
+		for _, index := range list[heads[pe]:] {
+			if active[pe] >= max_backfills {
+				return
+			}
+			start(index)
+		}
+	}
+
+	for i := range moves {
+		start(i)
+	}
+
+	now := 0.0
+	for len(running) > 0 {
+		rates := make([]float64, len(running))
+		dt := math.MaxFloat64
+		for i, t := range running {
+			rate := math.Min(pe_bandwidth/float64(active[t.from]), pe_bandwidth/float64(active[t.to]))
+			if t.cross && mg_bandwidth > 0 {
+				rate = math.Min(rate, mg_bandwidth/float64(mg_active[t.from.mg_id]))
+				rate = math.Min(rate, mg_bandwidth/float64(mg_active[t.to.mg_id]))
+			}
+			rates[i] = rate
+			dt = math.Min(dt, t.remaining/rate)
+		}
+
+		now += dt
+		for pe, n := range active {
+			if n > 0 {
+				busy[pe] += dt
+			}
+		}
+
+		freed := make([]peRef, 0)
+		next := running[:0]
+		for i, t := range running {
+			t.remaining -= rates[i] * dt
+			if t.remaining > size*1e-9 {
+				next = append(next, t)
+				continue
+			}
+			active[t.from]--
+			active[t.to]--
+			if t.cross {
+				mg_active[t.from.mg_id]--
+				mg_active[t.to.mg_id]--
+			}
+			done = append(done, now)
+			freed = append(freed, t.from, t.to)
+		}
+		running = next
+		for _, pe := range freed {
+			fill(pe)
+		}
+	}
+
+	report.Seconds = now
+	for pe, v := range busy {
+		if v > report.BusiestSeconds || (v == report.BusiestSeconds && counts[pe] > report.BusiestMoves) {
+			report.BusiestMgId, report.BusiestPeId = pe.mg_id, pe.pe_id
+			report.BusiestSeconds, report.BusiestMoves = v, counts[pe]
+		}
+	}
+
+	step := float64(model.Step)
+	if step == 0 {
+		step = now / ProgressSteps
+	}
+	moved := 0
+	for i := 1; ; i++ {
+		// The last point is at now, even if rounding put it a bit later
+		// or earlier than the last step.
+		t, last := float64(i)*step, false
+		if t >= now*(1-1e-9) {
+			t, last = now, true
+		}
+		for moved < len(done) && (last || done[moved] <= t) {
+			moved++
+		}
+		report.Progress = append(report.Progress, &ProgressPoint{Seconds: t, Moved: moved, Percent: float64(moved) * 100 / float64(len(done))})
+		if last {
+			break
+		}
+	}
+	return report
+}
+
+func formatSeconds(seconds float64) string {
+	return time.Duration(seconds * float64(time.Second)).Round(time.Millisecond).String()
+}
+
+// PrintTiming writes the duration and the busiest PE, and with progress
+// the progress curve.
+func PrintTiming(w io.Writer, report *TimingReport, progress bool) {
+	fmt.Fprintf(w, Msg("timing"), report.Moves, float64(report.Bytes)/(1<<30), formatSeconds(report.Seconds))
+	if report.Moves == 0 {
+		return
+	}
+	fmt.Fprintf(w, Msg("timing_busiest"), report.BusiestMgId, report.BusiestPeId, formatSeconds(report.BusiestSeconds), report.BusiestMoves)
+	if !progress {
+		return
+	}
+	for _, v := range report.Progress {
+		fmt.Fprintf(w, "    %12s %8d %6.2f%%\n", formatSeconds(v.Seconds), v.Moved, v.Percent)
+	}
+}
+
+// ActionMigrationModel sets the model that times the moves of the actions
+// after it.
+type ActionMigrationModel struct {
+	model MigrationModel
+}
+
+func (self *ActionMigrationModel) Run(sbc *straw2.Device) (*straw2.Device, error) {
+	return sbc, nil
+}
+
+func (self *ActionMigrationModel) Params() map[string]uint32 {
+	return map[string]uint32{
+		"key_size":      self.model.KeySize,
+		"pe_bandwidth":  self.model.PeBandwidth,
+		"mg_bandwidth":  self.model.MgBandwidth,
+		"max_backfills": self.model.MaxBackfills,
+		"step":          self.model.Step,
+	}
+}
+
+func (self *ActionMigrationModel) Name() string {
+	return "migration_model"
+}
+
+func (self *ActionMigrationModel) Enter() string {
+	return fmt.Sprintf(Msg("enter_migration_model"), self.model.KeySize, self.model.PeBandwidth, self.model.MgBandwidth, self.model.MaxBackfills)
+}
@@ -0,0 +1,520 @@
+package sim
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"straw2"
+)
+
+type TopologyPe struct {
+	id     uint32
+	weight uint32
+	labels map[string]string
+}
+
+type TopologyMg struct {
+	id     uint32
+	labels map[string]string
+	pes    []*TopologyPe
+}
+
+// Topology lists every MG and PE of a device explicitly. An inline topology
+// has a name, a topology loaded from a file keeps the file name as written.
+type Topology struct {
+	name     string
+	file     string
+	mgs      []*TopologyMg
+	warnings []string
+}
+
+// Warnings returns what was lost loading the topology, e.g. the bucket
+// algorithms of a crushmap other than straw2.
+func (self *Topology) Warnings() []string {
+	return self.warnings
+}
+
+var topologyMgParams = []*ParamSpec{
+	{Name: "id", Help: "MG id"},
+	{Name: "labels", Help: "labels as \"key=value,...\"", Kind: ParamString, Optional: true},
+}
+
+var topologyPeParams = []*ParamSpec{
+	{Name: "id", Help: "PE id"},
+	{Name: "weight", Help: "PE weight", Default: 1, HasDefault: true, Min: 1},
+	{Name: "labels", Help: "labels as \"key=value,...\"", Kind: ParamString, Optional: true},
+}
+
+func ParseLabels(str string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, v := range strings.Split(str, ",") {
+		v = strings.TrimSpace(v)
+		if len(v) == 0 {
+			continue
+		}
+
+		index := strings.Index(v, "=")
+		if index <= 0 {
+			return nil, fmt.Errorf("label \"%s\" is not \"key=value\"", v)
+		}
+		labels[strings.TrimSpace(v[:index])] = strings.TrimSpace(v[index+1:])
+	}
+	return labels, nil
+}
+
+func FormatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k, _ := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	str := ""
+	for i, k := range keys {
+		if i > 0 {
+			str += ","
+		}
+		str += k + "=" + labels[k]
+	}
+	return str
+}
+
+func (self *Topology) FindMg(mg_id uint32) (*TopologyMg, bool) {
+	for _, v := range self.mgs {
+		if v.id == mg_id {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func (self *TopologyMg) FindPe(pe_id uint32) (*TopologyPe, bool) {
+	for _, v := range self.pes {
+		if v.id == pe_id {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func (self *Topology) Check() []error {
+	errors := make([]error, 0)
+	if len(self.mgs) == 0 {
+		errors = append(errors, fmt.Errorf("topology has no MG"))
+	}
+
+	// MG and device weights are uint32 sums of the PE weights, they must
+	// not wrap around.
+	device_weight := uint64(0)
+	mg_ids := make(map[uint32]bool)
+	for _, mg := range self.mgs {
+		if mg_ids[mg.id] {
+			errors = append(errors, fmt.Errorf("duplicate MG[%d]", mg.id))
+		}
+		mg_ids[mg.id] = true
+
+		if len(mg.pes) == 0 {
+			errors = append(errors, fmt.Errorf("MG[%d] has no PE", mg.id))
+		}
+
+		mg_weight := uint64(0)
+		pe_ids := make(map[uint32]bool)
+		for _, pe := range mg.pes {
+			if pe_ids[pe.id] {
+				errors = append(errors, fmt.Errorf("duplicate MG[%d] PE[%d]", mg.id, pe.id))
+			}
+			pe_ids[pe.id] = true
+
+			if pe.weight == 0 {
+				errors = append(errors, fmt.Errorf("MG[%d] PE[%d] has weight 0", mg.id, pe.id))
+			}
+			mg_weight += uint64(pe.weight)
+		}
+		if mg_weight > math.MaxUint32 {
+			errors = append(errors, fmt.Errorf("MG[%d] weight %d overflows 32 bits", mg.id, mg_weight))
+		}
+		device_weight += mg_weight
+	}
+	if device_weight > math.MaxUint32 {
+		errors = append(errors, fmt.Errorf("device weight %d overflows 32 bits", device_weight))
+	}
+	return errors
+}
+
+func (self *Topology) NewDevice() *straw2.Device {
+	device := &straw2.Device{}
+	for _, v := range self.mgs {
+		mg := &straw2.MG{Id: v.id, Labels: v.labels}
+		for _, pe := range v.pes {
+			mg.AddPe(pe.id, pe.weight)
+			mg.Pes[len(mg.Pes)-1].Labels = pe.labels
+		}
+		device.AddMg(mg)
+	}
+	return device
+}
+
+func (self *Topology) Size() (mg_num, pe_num uint32) {
+	for _, v := range self.mgs {
+		pe_num += uint32(len(v.pes))
+	}
+	return uint32(len(self.mgs)), pe_num
+}
+
+// parseTopologyBody parses "mg:" and "pe:" statements until "}" or the end
+// of the file. Every "pe:" belongs to the "mg:" before it.
+func (self *Parser) parseTopologyBody(topology *Topology) {
+	for self.tok.kind != TokenEOF && self.tok.kind != TokenRBrace {
+		if self.tok.kind == TokenNewline {
+			self.next()
+			continue
+		}
+
+		if !self.parseTopologyStmt(topology) {
+			self.skipLine()
+		}
+	}
+}
+
+func (self *Parser) parseTopologyStmt(topology *Topology) bool {
+	stmt, ok := self.parseStmt()
+	if !ok || stmt == nil {
+		return ok
+	}
+
+	specs := topologyMgParams
+	if stmt.name == "pe" {
+		specs = topologyPeParams
+	} else if stmt.name != "mg" {
+		self.errorAt(stmt.line, stmt.column, "expected \"mg\" or \"pe\" in topology, found \"%s\"", stmt.name)
+		return true
+	}
+
+	args, ok := self.collectParams(specs, stmt)
+	if !ok {
+		return true
+	}
+	for _, err := range FillParams(fmt.Sprintf("\"%s\"", stmt.name), specs, args) {
+		self.errorAt(stmt.line, stmt.column, "%v", err)
+		ok = false
+	}
+
+	labels, err := ParseLabels(args.strs["labels"])
+	if err != nil {
+		self.errorAt(stmt.line, stmt.column, "%v", err)
+		ok = false
+	}
+	if !ok {
+		return true
+	}
+
+	if stmt.name == "mg" {
+		topology.mgs = append(topology.mgs, &TopologyMg{id: args.values["id"], labels: labels})
+		return true
+	}
+
+	if len(topology.mgs) == 0 {
+		self.errorAt(stmt.line, stmt.column, "\"pe\" before the first \"mg\" in topology")
+		return true
+	}
+	mg := topology.mgs[len(topology.mgs)-1]
+	mg.pes = append(mg.pes, &TopologyPe{id: args.values["id"], weight: args.values["weight"], labels: labels})
+	return true
+}
+
+func (self *Parser) checkTopology(topology *Topology, line, column int) bool {
+	errors := topology.Check()
+	for _, err := range errors {
+		self.errorAt(line, column, "%v", err)
+	}
+	return len(errors) == 0
+}
+
+// parseTopology parses an inline "topology NAME { ... }" block.
+func (self *Parser) parseTopology(keyword *Token) bool {
+	name, _ := self.expect(TokenIdent)
+	if _, ok := self.expect(TokenLBrace); !ok {
+		return false
+	}
+
+	if _, ok := self.ctx.topologies[name.text]; ok {
+		self.errorAt(name.line, name.column, "duplicate topology \"%s\"", name.text)
+		return false
+	}
+
+	topology := &Topology{name: name.text}
+	errors := len(self.ctx.errors)
+	self.parseTopologyBody(topology)
+	if self.tok.kind != TokenRBrace {
+		self.errorAt(keyword.line, keyword.column, "missing %s for \"%s\"", TokenRBrace, keyword.text)
+		return false
+	}
+	self.next()
+
+	if len(self.ctx.errors) > errors || !self.checkTopology(topology, name.line, name.column) {
+		return true
+	}
+	self.ctx.topologies[name.text] = topology
+	return true
+}
+
+// resolveTopology returns the inline topology with the given name, or loads
+// a topology file relative to the file being parsed.
+func (self *Parser) resolveTopology(param *Param) (*Topology, bool) {
+	if param.kind == TokenIdent {
+		topology, ok := self.ctx.topologies[param.str]
+		if !ok {
+			self.errorAt(param.line, param.column, "undefined topology \"%s\"", param.str)
+		}
+		return topology, ok
+	}
+
+	if self.ctx.noFiles {
+		self.errorAt(param.line, param.column, "topology file \"%s\" is not allowed here", param.str)
+		return nil, false
+	}
+	topology, errors := LoadTopology(param.str, filepath.Dir(self.filename))
+	for _, v := range errors {
+		self.ctx.errors = append(self.ctx.errors, v)
+	}
+	if len(errors) > 0 {
+		self.errorAt(param.line, param.column, "cannot load topology file \"%s\"", param.str)
+		return nil, false
+	}
+	self.ctx.warnings = append(self.ctx.warnings, topology.Warnings()...)
+	return topology, true
+}
+
+func LoadTopologyDoc(doc interface{}) (*Topology, []error) {
+	root, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, []error{fmt.Errorf("topology must be a mapping with an \"mgs\" list")}
+	}
+
+	list, ok := root["mgs"].([]interface{})
+	if !ok || len(root) != 1 {
+		return nil, []error{fmt.Errorf("topology must have only an \"mgs\" list")}
+	}
+
+	topology := &Topology{}
+	errors := make([]error, 0)
+	for i, v := range list {
+		fields, ok := v.(map[string]interface{})
+		if !ok {
+			errors = append(errors, fmt.Errorf("mgs[%d]: MG must be a mapping", i))
+			continue
+		}
+
+		args, labels, errs := loadTopologyItem(fmt.Sprintf("mgs[%d]", i), topologyMgParams, fields, "pes")
+		errors = append(errors, errs...)
+		mg := &TopologyMg{id: args.values["id"], labels: labels}
+
+		pes, ok := fields["pes"].([]interface{})
+		if !ok {
+			errors = append(errors, fmt.Errorf("mgs[%d]: MG must have a \"pes\" list", i))
+			continue
+		}
+
+		for j, pe := range pes {
+			what := fmt.Sprintf("mgs[%d].pes[%d]", i, j)
+			pe_fields, ok := pe.(map[string]interface{})
+			if !ok {
+				errors = append(errors, fmt.Errorf("%s: PE must be a mapping", what))
+				continue
+			}
+
+			args, labels, errs := loadTopologyItem(what, topologyPeParams, pe_fields, "")
+			errors = append(errors, errs...)
+			mg.pes = append(mg.pes, &TopologyPe{id: args.values["id"], weight: args.values["weight"], labels: labels})
+		}
+		topology.mgs = append(topology.mgs, mg)
+	}
+
+	if len(errors) > 0 {
+		return nil, errors
+	}
+	if errors = topology.Check(); len(errors) > 0 {
+		return nil, errors
+	}
+	return topology, nil
+}
+
+func loadTopologyItem(what string, specs []*ParamSpec, fields map[string]interface{}, skip string) (*ActionArgs, map[string]string, []error) {
+	args := NewActionArgs(nil)
+	labels := make(map[string]string)
+	errors := make([]error, 0)
+
+	for k, v := range fields {
+		switch {
+		case k == skip:
+		case k == "labels":
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				errors = append(errors, fmt.Errorf("%s: labels must be a mapping", what))
+				continue
+			}
+			for key, val := range m {
+				labels[key] = fmt.Sprintf("%v", val)
+			}
+			args.strs[k] = FormatLabels(labels)
+		default:
+			val, ok := scenarioUint32(v)
+			if !ok {
+				errors = append(errors, fmt.Errorf("%s: value %v of parameter \"%s\" is not an unsigned 32-bit integer", what, v, k))
+				continue
+			}
+			args.values[k] = val
+		}
+	}
+
+	for _, err := range FillParams(what, specs, args) {
+		errors = append(errors, fmt.Errorf("%s: %v", what, err))
+	}
+	return args, labels, errors
+}
+
+// LoadTopology reads a topology file in the actions file syntax, or YAML,
+// JSON or a crushmap by extension. A relative file name is resolved against dir.
+func LoadTopology(filename, dir string) (*Topology, []*ParseError) {
+	path := filename
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, []*ParseError{{filename: path, msg: "cannot open topology file"}}
+	}
+
+	if IsCrushMap(path, string(data)) {
+		topology, errors := LoadCrushMap(path, string(data))
+		if topology != nil {
+			topology.file = filename
+		}
+		return topology, errors
+	}
+
+	var doc interface{}
+	switch ScenarioFormat(path) {
+	case FormatJson:
+		decoder := json.NewDecoder(strings.NewReader(string(data)))
+		decoder.UseNumber()
+		err = decoder.Decode(&doc)
+	case FormatYaml:
+		doc, err = ParseYaml(string(data))
+	default:
+		ctx := NewParseContext()
+		parser := NewParser(path, string(data), ctx)
+		topology := &Topology{file: filename}
+		parser.parseTopologyBody(topology)
+		if parser.tok.kind == TokenRBrace {
+			parser.errorAt(parser.tok.line, parser.tok.column, "unexpected %s", parser.tok)
+		}
+		if len(ctx.errors) == 0 {
+			parser.checkTopology(topology, 0, 0)
+		}
+		if len(ctx.errors) > 0 {
+			return nil, ctx.errors
+		}
+		return topology, nil
+	}
+
+	if err != nil {
+		return nil, []*ParseError{{filename: path, msg: err.Error()}}
+	}
+
+	topology, errors := LoadTopologyDoc(doc)
+	if len(errors) > 0 {
+		parse_errors := make([]*ParseError, 0, len(errors))
+		for _, v := range errors {
+			parse_errors = append(parse_errors, &ParseError{filename: path, msg: v.Error()})
+		}
+		return nil, parse_errors
+	}
+	topology.file = filename
+	return topology, nil
+}
+
+func (self *Topology) Cfg(indent string) string {
+	buf := &bytes.Buffer{}
+	for _, mg := range self.mgs {
+		fmt.Fprintf(buf, "%smg: id = %d", indent, mg.id)
+		if len(mg.labels) > 0 {
+			fmt.Fprintf(buf, ", labels = %q", FormatLabels(mg.labels))
+		}
+		buf.WriteString("\n")
+
+		for _, pe := range mg.pes {
+			fmt.Fprintf(buf, "%spe: id = %d, weight = %d", indent, pe.id, pe.weight)
+			if len(pe.labels) > 0 {
+				fmt.Fprintf(buf, ", labels = %q", FormatLabels(pe.labels))
+			}
+			buf.WriteString("\n")
+		}
+	}
+	return buf.String()
+}
+
+func (self *Topology) Doc() map[string]interface{} {
+	mgs := make([]interface{}, 0, len(self.mgs))
+	for _, mg := range self.mgs {
+		pes := make([]interface{}, 0, len(mg.pes))
+		for _, pe := range mg.pes {
+			item := map[string]interface{}{"id": pe.id, "weight": pe.weight}
+			if len(pe.labels) > 0 {
+				item["labels"] = pe.labels
+			}
+			pes = append(pes, item)
+		}
+
+		item := map[string]interface{}{"id": mg.id, "pes": pes}
+		if len(mg.labels) > 0 {
+			item["labels"] = mg.labels
+		}
+		mgs = append(mgs, item)
+	}
+	return map[string]interface{}{"mgs": mgs}
+}
+
+func yamlLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k, _ := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	str := "{"
+	for i, k := range keys {
+		if i > 0 {
+			str += ", "
+		}
+		str += YamlQuote(k) + ": " + YamlQuote(labels[k])
+	}
+	return str + "}"
+}
+
+func (self *Topology) Yaml(indent string) string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%smgs:\n", indent)
+	for _, mg := range self.mgs {
+		fmt.Fprintf(buf, "%s  - id: %d\n", indent, mg.id)
+		if len(mg.labels) > 0 {
+			fmt.Fprintf(buf, "%s    labels: %s\n", indent, yamlLabels(mg.labels))
+		}
+		fmt.Fprintf(buf, "%s    pes:\n", indent)
+		for _, pe := range mg.pes {
+			fmt.Fprintf(buf, "%s      - {id: %d, weight: %d", indent, pe.id, pe.weight)
+			if len(pe.labels) > 0 {
+				fmt.Fprintf(buf, ", labels: %s", yamlLabels(pe.labels))
+			}
+			buf.WriteString("}\n")
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,144 @@
+package sim
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"straw2"
+)
+
+// KeyStep is where a traced key is after one action of a run.
+type KeyStep struct {
+	Index  int
+	Action string
+	Branch string
+	MgId   uint32
+	PeId   uint32
+	Stored bool
+	Err    error
+}
+
+func (self *KeyStep) same(step *KeyStep) bool {
+	return self.MgId == step.MgId && self.PeId == step.PeId && self.Stored == step.Stored && (self.Err == nil) == (step.Err == nil)
+}
+
+// ActionWhere prints the trace of a key and the PEs it has been on since
+// the start of the run.
+type ActionWhere struct {
+	key uint32
+}
+
+func (self *ActionWhere) Run(sbc *straw2.Device) (*straw2.Device, error) {
+	if sbc == nil {
+		return nil, ErrNoDevice
+	}
+	_, err := sbc.Trace(self.key)
+	return sbc, err
+}
+
+func (self *ActionWhere) Params() map[string]uint32 {
+	return map[string]uint32{
+		"key": self.key,
+	}
+}
+
+func (self *ActionWhere) Name() string {
+	return "where"
+}
+
+func (self *ActionWhere) Enter() string {
+	return fmt.Sprintf(Msg("enter_where"), self.key)
+}
+
+func formatDraw(draw float64) string {
+	if draw == -math.MaxFloat64 {
+		return "-inf"
+	}
+	return fmt.Sprintf("%.6f", draw)
+}
+
+func printDraws(w io.Writer, kind string, draws []straw2.Draw, winner uint32) {
+	for _, v := range draws {
+		mark := " "
+		if v.Id == winner {
+			mark = "*"
+		}
+		fmt.Fprintf(w, "  %s %s[%d]: weight = %d, hash = 0x%08x, draw = %s\n", mark, kind, v.Id, v.Weight, v.Hash, formatDraw(v.Draw))
+	}
+}
+
+// PrintTrace writes the draws of both levels of trace, the winners marked
+// with *.
+func PrintTrace(w io.Writer, trace *straw2.Trace) {
+	fmt.Fprintf(w, Msg("trace_key"), trace.Key, trace.MgId, trace.PeId, trace.Stored)
+	fmt.Fprintf(w, Msg("trace_mg_bucket"), len(trace.MgDraws))
+	printDraws(w, "MG", trace.MgDraws, trace.MgId)
+	fmt.Fprintf(w, Msg("trace_pe_bucket"), trace.MgId, len(trace.PeDraws))
+	printDraws(w, "PE", trace.PeDraws, trace.PeId)
+}
+
+// PrintKeySteps writes the steps where the location of the key changed.
+func PrintKeySteps(w io.Writer, key uint32, steps []*KeyStep) {
+	fmt.Fprintf(w, Msg("trace_history"), key)
+	var last *KeyStep
+	for _, v := range steps {
+		if last != nil && last.same(v) {
+			continue
+		}
+		last = v
+
+		name := v.Action
+		if len(v.Branch) > 0 {
+			name = v.Branch + "/" + name
+		}
+		if v.Err != nil {
+			fmt.Fprintf(w, "  %4d %-32v %s\n", v.Index, v.Err, name)
+			continue
+		}
+		location := fmt.Sprintf("MG[%d] PE[%d], stored = %v", v.MgId, v.PeId, v.Stored)
+		fmt.Fprintf(w, "  %4d %-32s %s\n", v.Index, location, name)
+	}
+}
+
+// tracedKeys adds the keys of the where actions of self, in branches too.
+func (self *ActionList) tracedKeys(keys map[uint32][]*KeyStep) {
+	for _, v := range self.actions {
+		switch action := v.(type) {
+		case *ActionWhere:
+			keys[action.key] = make([]*KeyStep, 0)
+		case *ActionBranch:
+			for _, alt := range action.alts {
+				alt.actions.tracedKeys(keys)
+			}
+		}
+	}
+}
+
+// track records where every traced key is after the action at index.
+func (self *ActionList) track(index int, action string, branch string, device *straw2.Device) {
+	for key, steps := range self.traced {
+		step := &KeyStep{Index: index, Action: action, Branch: branch}
+		trace, err := device.Trace(key)
+		if err != nil {
+			step.Err = err
+		} else {
+			step.MgId, step.PeId, step.Stored = trace.MgId, trace.PeId, trace.Stored
+		}
+		self.traced[key] = append(steps, step)
+	}
+}
+
+// keySteps returns the steps of key that led to an action in branch: the
+// steps outside any branch and those of branch and its enclosing
+// alternatives.
+func (self *ActionList) keySteps(key uint32, branch string) []*KeyStep {
+	steps := make([]*KeyStep, 0)
+	for _, v := range self.traced[key] {
+		if len(v.Branch) == 0 || v.Branch == branch || strings.HasPrefix(branch, v.Branch+"/") {
+			steps = append(steps, v)
+		}
+	}
+	return steps
+}
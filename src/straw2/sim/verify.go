@@ -0,0 +1,60 @@
+package sim
+
+import (
+	"fmt"
+	"strings"
+
+	"straw2"
+)
+
+// VerifyError holds the problems Device.Verify found.
+type VerifyError struct {
+	Problems []error
+}
+
+func (self *VerifyError) Error() string {
+	strs := make([]string, 0, 4)
+	for i, v := range self.Problems {
+		if i == 3 {
+			strs = append(strs, fmt.Sprintf("and %d more", len(self.Problems)-i))
+			break
+		}
+		strs = append(strs, v.Error())
+	}
+	return fmt.Sprintf("%d problem(s): %s", len(self.Problems), strings.Join(strs, "; "))
+}
+
+func (self *VerifyError) Unwrap() []error {
+	return self.Problems
+}
+
+// VerifyDevice returns a VerifyError if the invariants of device do not
+// hold.
+func VerifyDevice(device *straw2.Device) error {
+	if device == nil {
+		return ErrNoDevice
+	}
+	if problems := device.Verify(); len(problems) > 0 {
+		return &VerifyError{Problems: problems}
+	}
+	return nil
+}
+
+type ActionVerify struct {
+}
+
+func (self *ActionVerify) Run(sbc *straw2.Device) (*straw2.Device, error) {
+	return sbc, VerifyDevice(sbc)
+}
+
+func (self *ActionVerify) Params() map[string]uint32 {
+	return map[string]uint32{}
+}
+
+func (self *ActionVerify) Name() string {
+	return "verify"
+}
+
+func (self *ActionVerify) Enter() string {
+	return Msg("enter_verify")
+}
@@ -0,0 +1,396 @@
+package sim
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Only the YAML subset used by scenario files is supported: block mappings
+// and sequences, one-line flow collections, scalars and comments.
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+type yamlPos struct {
+	line   int
+	column int
+}
+
+type YamlParser struct {
+	lines []*yamlLine
+	pos   int
+	// nodes maps the path of each block node, such as "actions[2].mg_id",
+	// to where it starts.
+	nodes map[string]yamlPos
+}
+
+func stripYamlComment(line string) string {
+	quote := rune(0)
+	for i, ch := range line {
+		switch {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'':
+			quote = ch
+		case ch == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func ParseYaml(src string) (interface{}, error) {
+	doc, _, err := parseYaml(src)
+	return doc, err
+}
+
+// parseYaml also returns the positions of the block nodes of the document.
+func parseYaml(src string) (interface{}, map[string]yamlPos, error) {
+	parser := &YamlParser{nodes: make(map[string]yamlPos)}
+	for i, line := range strings.Split(src, "\n") {
+		line = strings.TrimRight(stripYamlComment(strings.TrimRight(line, "\r")), " \t")
+		text := strings.TrimLeft(line, " ")
+		if len(text) == 0 || text == "---" {
+			continue
+		}
+		if strings.HasPrefix(text, "\t") {
+			return nil, nil, fmt.Errorf("line %d: tab indentation is not allowed", i+1)
+		}
+		parser.lines = append(parser.lines, &yamlLine{num: i + 1, indent: len(line) - len(text), text: text})
+	}
+
+	if len(parser.lines) == 0 {
+		return nil, parser.nodes, nil
+	}
+
+	first := parser.lines[0]
+	parser.nodes[""] = yamlPos{line: first.num, column: first.indent + 1}
+	val, err := parser.parseBlock(first.indent, "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if parser.pos < len(parser.lines) {
+		line := parser.lines[parser.pos]
+		return nil, nil, fmt.Errorf("line %d: unexpected indentation", line.num)
+	}
+	return val, parser.nodes, nil
+}
+
+func (self *YamlParser) parseBlock(indent int, path string) (interface{}, error) {
+	line := self.lines[self.pos]
+	if line.text == "-" || strings.HasPrefix(line.text, "- ") {
+		return self.parseSeq(indent, path)
+	}
+	if _, _, ok := splitYamlKey(line.text); ok {
+		return self.parseMap(indent, path)
+	}
+
+	self.pos++
+	return parseYamlScalar(line.text, line.num)
+}
+
+func (self *YamlParser) parseSeq(indent int, path string) (interface{}, error) {
+	seq := make([]interface{}, 0)
+	for self.pos < len(self.lines) {
+		line := self.lines[self.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", line.num)
+		}
+		if line.text != "-" && !strings.HasPrefix(line.text, "- ") {
+			break
+		}
+
+		item_path := fmt.Sprintf("%s[%d]", path, len(seq))
+		self.nodes[item_path] = yamlPos{line: line.num, column: line.indent + 1}
+
+		item := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+		if len(item) == 0 {
+			self.pos++
+			if self.pos >= len(self.lines) || self.lines[self.pos].indent <= indent {
+				seq = append(seq, nil)
+				continue
+			}
+			val, err := self.parseBlock(self.lines[self.pos].indent, item_path)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, val)
+			continue
+		}
+
+		// "- key: value" starts a mapping indented at the item text.
+		line.indent += len(line.text) - len(item)
+		line.text = item
+		val, err := self.parseBlock(line.indent, item_path)
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, val)
+	}
+	return seq, nil
+}
+
+func splitYamlKey(text string) (string, string, bool) {
+	if strings.HasPrefix(text, "{") || strings.HasPrefix(text, "[") || strings.HasPrefix(text, "\"") || strings.HasPrefix(text, "'") {
+		return "", "", false
+	}
+
+	index := strings.Index(text, ": ")
+	if index < 0 {
+		if !strings.HasSuffix(text, ":") {
+			return "", "", false
+		}
+		index = len(text) - 1
+	}
+	return strings.TrimSpace(text[:index]), strings.TrimSpace(text[index+1:]), true
+}
+
+func (self *YamlParser) parseMap(indent int, path string) (interface{}, error) {
+	m := make(map[string]interface{})
+	for self.pos < len(self.lines) {
+		line := self.lines[self.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", line.num)
+		}
+
+		key, value, ok := splitYamlKey(line.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", line.num)
+		}
+		if _, ok := m[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key \"%s\"", line.num, key)
+		}
+		self.pos++
+
+		key_path := key
+		if len(path) > 0 {
+			key_path = path + "." + key
+		}
+		self.nodes[key_path] = yamlPos{line: line.num, column: line.indent + 1}
+
+		if len(value) > 0 {
+			val, err := parseYamlScalar(value, line.num)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = val
+			continue
+		}
+
+		if self.pos < len(self.lines) {
+			next := self.lines[self.pos]
+			sequence := next.text == "-" || strings.HasPrefix(next.text, "- ")
+			if next.indent > indent || (next.indent == indent && sequence) {
+				val, err := self.parseBlock(next.indent, key_path)
+				if err != nil {
+					return nil, err
+				}
+				m[key] = val
+				continue
+			}
+		}
+		m[key] = nil
+	}
+	return m, nil
+}
+
+func parseYamlScalar(text string, num int) (interface{}, error) {
+	if !strings.ContainsAny(text[:1], "[{\"'") {
+		return yamlPlain(text), nil
+	}
+
+	flow := &yamlFlow{text: text, num: num}
+	val, err := flow.parseValue()
+	if err != nil {
+		return nil, err
+	}
+
+	flow.skipSpace()
+	if flow.pos < len(flow.text) {
+		return nil, fmt.Errorf("line %d: unexpected \"%s\"", num, flow.text[flow.pos:])
+	}
+	return val, nil
+}
+
+type yamlFlow struct {
+	text string
+	pos  int
+	num  int
+}
+
+func (self *yamlFlow) skipSpace() {
+	for self.pos < len(self.text) && (self.text[self.pos] == ' ' || self.text[self.pos] == '\t') {
+		self.pos++
+	}
+}
+
+func (self *yamlFlow) parseValue() (interface{}, error) {
+	self.skipSpace()
+	if self.pos >= len(self.text) {
+		return nil, nil
+	}
+
+	switch self.text[self.pos] {
+	case '[':
+		return self.parseFlowSeq()
+	case '{':
+		return self.parseFlowMap()
+	case '"', '\'':
+		return self.parseQuoted()
+	}
+
+	begin := self.pos
+	for self.pos < len(self.text) {
+		ch := self.text[self.pos]
+		if ch == ',' || ch == ']' || ch == '}' {
+			break
+		}
+		self.pos++
+	}
+	return yamlPlain(strings.TrimSpace(self.text[begin:self.pos])), nil
+}
+
+func (self *yamlFlow) parseQuoted() (interface{}, error) {
+	quote := self.text[self.pos]
+	begin := self.pos
+	self.pos++
+	for self.pos < len(self.text) {
+		if self.text[self.pos] == '\\' && quote == '"' {
+			self.pos += 2
+			continue
+		}
+		if self.text[self.pos] == quote {
+			if quote == '\'' && self.pos+1 < len(self.text) && self.text[self.pos+1] == '\'' {
+				self.pos += 2
+				continue
+			}
+			self.pos++
+			str := self.text[begin:self.pos]
+			if quote == '\'' {
+				return strings.Replace(str[1:len(str)-1], "''", "'", -1), nil
+			}
+			val, err := strconv.Unquote(str)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid string %s", self.num, str)
+			}
+			return val, nil
+		}
+		self.pos++
+	}
+	return nil, fmt.Errorf("line %d: unterminated string", self.num)
+}
+
+func (self *yamlFlow) expect(ch byte) error {
+	self.skipSpace()
+	if self.pos >= len(self.text) || self.text[self.pos] != ch {
+		return fmt.Errorf("line %d: expected '%c'", self.num, ch)
+	}
+	self.pos++
+	return nil
+}
+
+func (self *yamlFlow) parseFlowSeq() (interface{}, error) {
+	self.pos++
+	seq := make([]interface{}, 0)
+	for {
+		self.skipSpace()
+		if self.pos < len(self.text) && self.text[self.pos] == ']' {
+			self.pos++
+			return seq, nil
+		}
+
+		val, err := self.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, val)
+
+		self.skipSpace()
+		if self.pos < len(self.text) && self.text[self.pos] == ',' {
+			self.pos++
+			continue
+		}
+		if err := self.expect(']'); err != nil {
+			return nil, err
+		}
+		return seq, nil
+	}
+}
+
+func (self *yamlFlow) parseFlowMap() (interface{}, error) {
+	self.pos++
+	m := make(map[string]interface{})
+	for {
+		self.skipSpace()
+		if self.pos < len(self.text) && self.text[self.pos] == '}' {
+			self.pos++
+			return m, nil
+		}
+
+		colon := strings.Index(self.text[self.pos:], ":")
+		if colon < 0 {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", self.num)
+		}
+		key := strings.Trim(strings.TrimSpace(self.text[self.pos:self.pos+colon]), "\"'")
+		self.pos += colon + 1
+
+		val, err := self.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		m[key] = val
+
+		self.skipSpace()
+		if self.pos < len(self.text) && self.text[self.pos] == ',' {
+			self.pos++
+			continue
+		}
+		if err := self.expect('}'); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+}
+
+func yamlPlain(text string) interface{} {
+	switch text {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+
+	if val, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return val
+	}
+	if val, err := strconv.ParseFloat(text, 64); err == nil {
+		return val
+	}
+	return text
+}
+
+func YamlQuote(str string) string {
+	if len(str) == 0 {
+		return "\"\""
+	}
+	if _, ok := yamlPlain(str).(string); ok && !strings.ContainsAny(str, ":#{}[],&*!|>'\"%@`") &&
+		strings.TrimSpace(str) == str && !strings.HasPrefix(str, "-") {
+		return str
+	}
+	return strconv.Quote(str)
+}
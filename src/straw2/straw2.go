@@ -0,0 +1,1000 @@
+// Package straw2 simulates placing keys on a device of MGs and PEs with
+// the straw2 algorithm of Ceph CRUSH, and moving them when the topology
+// changes.
+//
+// A key is placed by two straw2 draws: Device.Select picks an MG from the
+// MG bucket, then the MG picks one of its PEs from the PE bucket.
+package straw2
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"straw2/hash"
+)
+
+// Item is a child of a bucket, an MG of a device or a PE of an MG.
+type Item struct {
+	Id     uint32
+	Weight uint32
+}
+
+// Bucket holds the weighted items straw2 selects from. Weight is the sum of
+// the item weights.
+type Bucket struct {
+	Weight uint32
+	Items  []Item
+}
+
+func NewBucket() *Bucket {
+	return &Bucket{Items: make([]Item, 0)}
+}
+
+// Clone copies the bucket into bucket.
+func (self *Bucket) Clone(bucket *Bucket) {
+	bucket.Weight = self.Weight
+	bucket.Items = make([]Item, len(self.Items))
+	copy(bucket.Items, self.Items)
+}
+
+// AddItem appends an item and adds its weight to the bucket.
+func (self *Bucket) AddItem(id, weight uint32) {
+	self.Weight += weight
+	self.Items = append(self.Items, Item{Id: id, Weight: weight})
+}
+
+// DelItem removes the item at index.
+func (self *Bucket) DelItem(index uint32) {
+	self.Weight -= self.Items[index].Weight
+	self.Items = append(self.Items[:index], self.Items[index+1:]...)
+}
+
+// SetWeight changes the weight of the item at index.
+func (self *Bucket) SetWeight(index, weight uint32) {
+	old_weight := self.Items[index].Weight
+	if weight >= old_weight {
+		self.Weight += weight - old_weight
+	} else {
+		self.Weight -= old_weight - weight
+	}
+
+	self.Items[index].Weight = weight
+}
+
+// Select returns the id of the item with the highest straw2 draw for key x.
+// Items with weight 0 are never selected; without any weighted item it
+// returns 0.
+func (bucket *Bucket) Select(x uint32) uint32 {
+	max_item_id := uint32(0)
+	max_draw := -math.MaxFloat64
+	for _, item := range bucket.Items {
+		draw := -math.MaxFloat64
+		id := item.Id
+		weight := item.Weight
+		if weight != 0 {
+			//h := Hash(x * uint32(id+100))
+			//fmt.Println("id =", id)
+			//h := Hash2(x, uint32(id))
+			h := hash.Rjenkins2(x, uint32(id))
+			//fmt.Printf("x = %d, mg_id = %d, h = %d\n", x, id, h)
+			//fmt.Println("h =", h)
+			//h &= 0xffff
+			//draw = math.Log(float64(h)/65536.0) / float64(item.Weight)
+			draw = straw2Draw(h, weight)
+		}
+
+		if draw > max_draw {
+			max_item_id = id
+			max_draw = draw
+		}
+	}
+	//fmt.Println("mg_id =", max_item_id)
+	return max_item_id
+}
+
+// beats reports whether Select would rather return the item at index than
+// the item at other for key x: it draws higher, or as high and comes first.
+func (bucket *Bucket) beats(index, other int, x uint32) bool {
+	item, other_item := bucket.Items[index], bucket.Items[other]
+	a := straw2Draw(hash.Rjenkins2(x, item.Id), item.Weight)
+	b := straw2Draw(hash.Rjenkins2(x, other_item.Id), other_item.Weight)
+	return a > b || (a == b && index < other)
+}
+
+// Select2 is Select for the PE bucket of MG mg_id, so the same key draws
+// differently in every MG.
+func (bucket *Bucket) Select2(mg_id, x uint32) uint32 {
+	max_item_id := uint32(0)
+	max_draw := -math.MaxFloat64
+	for _, item := range bucket.Items {
+		draw := -math.MaxFloat64
+		id := item.Id
+		weight := item.Weight
+		if weight != 0 {
+			//h := Hash(x * uint32(id+100))
+			//fmt.Println("id =", id)
+			//h := Hash(x * uint32(id+100) * (mg_id + 200))
+			//h := Hash2(x*uint32(id+100), mg_id)
+			//h := Hash3(x, mg_id, uint32(id))
+			//h := hash.Rjenkins2(x, (mg_id+100)*uint32(id))
+			h := hash.Rjenkins3(x, mg_id, uint32(id))
+			//fmt.Printf("y = %d, mg_id = %d, h = %d\n", x, id, h)
+			//fmt.Println("h =", h)
+			//h &= 0xffff
+			//draw = math.Log(float64(h)/65536.0) / float64(item.Weight)
+			draw = straw2Draw(h, weight)
+		}
+
+		if draw > max_draw {
+			max_item_id = id
+			max_draw = draw
+		}
+	}
+	//fmt.Println("pe_id =", max_item_id)
+	return max_item_id
+}
+
+// DistributeStat compares key counts against weight-proportional targets.
+// The percents are fractions of the target, 0.01 is 1%.
+type DistributeStat struct {
+	AverageBias        float64
+	AverageBiasPercent float64
+	MaxBias            uint32
+	MaxBiasPercent     float64
+}
+
+func (self *DistributeStat) String() string {
+	return fmt.Sprintf("average bias = %2.2f, average bias percent = %2.2f%%, max bias = %d, max bias percent = %2.2f%%", self.AverageBias, self.AverageBiasPercent*100, self.MaxBias, self.MaxBiasPercent*100)
+}
+
+// CalcDistributeStat computes the bias of counts against the share of the
+// total every weight stands for. Items with weight 0 are skipped.
+func CalcDistributeStat(counts, weights []uint32) DistributeStat {
+	stat := DistributeStat{}
+
+	total := uint64(0)
+	weight := uint64(0)
+	for i, v := range counts {
+		total += uint64(v)
+		weight += uint64(weights[i])
+	}
+
+	if len(counts) == 0 || weight == 0 {
+		return stat
+	}
+
+	num := 0
+	for i, v := range counts {
+		if weights[i] == 0 {
+			continue
+		}
+		standard := float64(total) * float64(weights[i]) / float64(weight)
+		bias := math.Abs(float64(v) - standard)
+
+		stat.AverageBias += bias
+		if uint32(bias+0.5) > stat.MaxBias {
+			stat.MaxBias = uint32(bias + 0.5)
+		}
+
+		if standard > 0 {
+			percent := bias / standard
+			stat.AverageBiasPercent += percent
+			if percent > stat.MaxBiasPercent {
+				stat.MaxBiasPercent = percent
+			}
+		}
+		num++
+	}
+
+	if num > 0 {
+		stat.AverageBias /= float64(num)
+		stat.AverageBiasPercent /= float64(num)
+	}
+
+	return stat
+}
+
+// MigrateStat counts keys moved in and out, accumulated since power on.
+type MigrateStat struct {
+	MigrateIn  uint32
+	MigrateOut uint32
+}
+
+func (self *MigrateStat) String() string {
+	return fmt.Sprintf("migrate in = %d, migrate out = %d", self.MigrateIn, self.MigrateOut)
+}
+
+// Clear resets both counters.
+func (self *MigrateStat) Clear() {
+	self.MigrateIn = 0
+	self.MigrateOut = 0
+}
+
+// PE is a placement element. Data holds its keys, mapped to themselves.
+type PE struct {
+	Id       uint32
+	Weight   uint32
+	Standard uint32
+	Data     map[uint32]uint32
+	Migrate  MigrateStat
+	Labels   map[string]string
+}
+
+func (self *PE) ClearData() {
+	for k, _ := range self.Data {
+		delete(self.Data, k)
+	}
+}
+
+func (self *PE) ClearMigrate() {
+	self.Migrate.Clear()
+}
+
+// AddData adds key data to the PE.
+func (self *PE) AddData(data uint32) error {
+	if _, ok := self.Data[data]; ok {
+		return fmt.Errorf("pe %d key %d: %w", self.Id, data, ErrKeyDuplicate)
+	}
+	self.Data[data] = data
+	return nil
+}
+
+// DelData removes key data from the PE.
+func (self *PE) DelData(data uint32) error {
+	if _, ok := self.Data[data]; !ok {
+		return fmt.Errorf("pe %d key %d: %w", self.Id, data, ErrKeyNotFound)
+	}
+	delete(self.Data, data)
+	return nil
+}
+
+func (self *PE) MigrateInData(data uint32) error {
+	if err := self.AddData(data); err != nil {
+		return err
+	}
+	self.Migrate.MigrateIn++
+	return nil
+}
+
+func (self *PE) MigrateOutData(data uint32) error {
+	if err := self.DelData(data); err != nil {
+		return err
+	}
+	self.Migrate.MigrateOut++
+	return nil
+}
+
+// Clone returns a deep copy of the keys. Labels are shared.
+func (self *PE) Clone() *PE {
+	pe := &PE{Id: self.Id, Weight: self.Weight, Migrate: self.Migrate, Labels: self.Labels}
+	pe.Data = make(map[uint32]uint32)
+	for k, v := range self.Data {
+		pe.Data[k] = v
+	}
+
+	return pe
+}
+
+func (self *PE) scaleOutMg(device *Device, mg_id uint32) error {
+	for key, _ := range self.Data {
+		to_mg_id, to_pe_id, err := device.Select(key)
+		if err != nil {
+			return err
+		}
+		if to_mg_id != mg_id {
+			if err := device.Migrate(mg_id, self.Id, to_mg_id, to_pe_id, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (self *PE) scaleInMg(device *Device, mg_id uint32) error {
+	for key, _ := range self.Data {
+		to_mg_id, to_pe_id, err := device.Select(key)
+		if err != nil {
+			return err
+		}
+		if to_mg_id == mg_id {
+			return fmt.Errorf("scale in mg %d: key %d stays on the mg: %w", mg_id, key, ErrInconsistent)
+		}
+		if err := device.Migrate(mg_id, self.Id, to_mg_id, to_pe_id, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *PE) String() string {
+	return fmt.Sprintf("PE[%d]: weight = %d, counts = %d, data = %v\n", self.Id, self.Weight, len(self.Data), self.Data)
+}
+
+// MG is a group of PEs. Total is the number of keys in all PEs, Weight
+// the sum of the PE weights.
+type MG struct {
+	Id       uint32
+	Weight   uint32
+	Total    uint32
+	Standard uint32
+	Pes      []*PE
+	Stat     DistributeStat
+	Migrate  MigrateStat
+	PeBucket Bucket
+	Labels   map[string]string
+}
+
+// NewMG returns an MG with pe_num PEs of pe_weight, numbered from 1.
+func NewMG(mg_id, pe_num, pe_weight uint32) *MG {
+	mg := &MG{Id: mg_id}
+	for i := uint32(0); i < pe_num; i++ {
+		mg.AddPe(i+1, pe_weight)
+	}
+	return mg
+}
+
+func (self *MG) GetId(index uint32) uint32 {
+	return self.Pes[index].Id
+}
+
+func (self *MG) GetWeight(index uint32) uint32 {
+	return self.Pes[index].Weight
+}
+
+// Size returns the number of PEs.
+func (self *MG) Size() uint32 {
+	return uint32(len(self.Pes))
+}
+
+// FindPeById reports whether the MG has PE pe_id.
+func (self *MG) FindPeById(pe_id uint32) bool {
+	for _, v := range self.Pes {
+		if v.Id == pe_id {
+			return true
+		}
+	}
+	return false
+}
+
+// GetPeIndex returns the position of PE pe_id in Pes.
+func (self *MG) GetPeIndex(pe_id uint32) (uint32, error) {
+	for i, v := range self.Pes {
+		if pe_id == v.Id {
+			return uint32(i), nil
+		}
+	}
+	return 0, fmt.Errorf("mg %d pe %d: %w", self.Id, pe_id, ErrPeNotFound)
+}
+
+func (self *MG) ClearData() {
+	for _, v := range self.Pes {
+		v.ClearData()
+	}
+	self.Total = 0
+}
+
+func (self *MG) ClearMigrate() {
+	self.Migrate.Clear()
+	for _, v := range self.Pes {
+		v.ClearMigrate()
+	}
+}
+
+func (self *MG) scaleOutMg(device *Device) error {
+	for _, v := range self.Pes {
+		if err := v.scaleOutMg(device, self.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *MG) scaleInMg(device *Device) error {
+	for _, v := range self.Pes {
+		if err := v.scaleInMg(device, self.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Select returns the PE of the MG key belongs to.
+func (self *MG) Select(key uint32) (uint32, error) {
+	if self.PeBucket.Weight == 0 {
+		return 0, fmt.Errorf("mg %d: %w", self.Id, ErrNoPe)
+	}
+	return self.PeBucket.Select2(self.Id, key), nil
+}
+
+// AddPe adds an empty PE and its bucket item.
+func (self *MG) AddPe(pe_id, weight uint32) error {
+	if self.FindPeById(pe_id) {
+		return fmt.Errorf("mg %d pe %d: %w", self.Id, pe_id, ErrPeExists)
+	}
+	self.Weight += weight
+	self.Pes = append(self.Pes, &PE{Id: pe_id, Weight: weight, Data: make(map[uint32]uint32, 0)})
+	self.PeBucket.AddItem(pe_id, weight)
+	return nil
+}
+
+// DelPe removes the PE at pe_index. The caller removes its bucket item.
+func (self *MG) DelPe(pe_index uint32) {
+	pe := self.Pes[pe_index]
+	self.Weight -= pe.Weight
+	self.Total -= uint32(len(pe.Data))
+	self.Pes = append(self.Pes[:pe_index], self.Pes[pe_index+1:]...)
+}
+
+func (self *MG) AddData(index, data uint32) error {
+	if err := self.Pes[index].AddData(data); err != nil {
+		return err
+	}
+	self.Total++
+	return nil
+}
+
+func (self *MG) DelData(pe_index, data uint32) error {
+	return self.Pes[pe_index].DelData(data)
+}
+
+func (self *MG) MigrateInData(pe_index, data uint32) error {
+	if err := self.Pes[pe_index].MigrateInData(data); err != nil {
+		return err
+	}
+	self.Migrate.MigrateIn++
+	self.Total++
+	return nil
+}
+
+func (self *MG) MigrateOutData(pe_index, data uint32) error {
+	if err := self.Pes[pe_index].MigrateOutData(data); err != nil {
+		return err
+	}
+	self.Migrate.MigrateOut++
+	self.Total--
+	return nil
+}
+
+func (self *MG) PeMigrateInData(pe_index, data uint32) error {
+	if err := self.Pes[pe_index].MigrateInData(data); err != nil {
+		return err
+	}
+	self.Total++
+	return nil
+}
+
+func (self *MG) PeMigrateOutData(pe_index, data uint32) error {
+	if err := self.Pes[pe_index].MigrateOutData(data); err != nil {
+		return err
+	}
+	self.Total--
+	return nil
+}
+
+// SetPeWeight changes the weight of the PE at index in the MG and in its
+// bucket. Keys are not moved.
+func (self *MG) SetPeWeight(index, weight uint32) {
+	old_weight := self.Pes[index].Weight
+	if weight >= old_weight {
+		self.Weight += weight - old_weight
+	} else {
+		self.Weight -= old_weight - weight
+	}
+
+	self.Pes[index].Weight = weight
+	self.PeBucket.SetWeight(index, weight)
+}
+
+// Clone returns a deep copy of the PEs and the bucket. Labels are shared.
+func (self *MG) Clone() *MG {
+	mg := &MG{Id: self.Id, Weight: self.Weight, Total: self.Total, Migrate: self.Migrate, Labels: self.Labels}
+	mg.Pes = make([]*PE, 0)
+	for _, v := range self.Pes {
+		mg.Pes = append(mg.Pes, v.Clone())
+	}
+	self.PeBucket.Clone(&mg.PeBucket)
+	return mg
+}
+
+func (self *MG) String() string {
+	str := fmt.Sprintf("MG[%d]: weight = %d, total = %d\n", self.Id, self.Weight, self.Total)
+
+	for _, pe := range self.Pes {
+		str += fmt.Sprintf("    %s", pe)
+	}
+	return str
+}
+
+// CalcStat updates Stat from the key counts of the PEs.
+func (self *MG) CalcStat() {
+	counts := make([]uint32, 0, len(self.Pes))
+	weights := make([]uint32, 0, len(self.Pes))
+	for _, pe := range self.Pes {
+		counts = append(counts, uint32(len(pe.Data)))
+		weights = append(weights, pe.Weight)
+	}
+	self.Stat = CalcDistributeStat(counts, weights)
+}
+
+func (self *MG) SetStandard(total uint32) {
+	pe_standard := total / self.Size()
+	for _, pe := range self.Pes {
+		pe.Standard = pe_standard
+	}
+}
+
+// MigrateKey is a cell of the migrate matrix.
+type MigrateKey struct {
+	FromMgId uint32
+	ToMgId   uint32
+}
+
+// Device is the top of the topology, holding MGs which hold PEs.
+//
+// The Scale methods never modify the receiver: they return a modified copy
+// with MigrateMatrix and Moves holding the keys moved by that change only,
+// or nil and an error if the change is not possible. Share a Device between
+// goroutines only as long as nobody calls the Add, Del and Set methods on
+// it.
+type Device struct {
+	Id            uint32
+	Weight        uint32
+	Total         uint32
+	Mgs           []*MG
+	Stat          DistributeStat
+	MgBucket      Bucket
+	MigrateMatrix map[MigrateKey]uint32
+	Moves         []Move
+}
+
+// NewDevice returns a device of mg_num MGs numbered from 1, each with
+// pe_num PEs of pe_weight.
+func NewDevice(mg_num, pe_num, pe_weight uint32) *Device {
+	device := &Device{}
+
+	for i := uint32(0); i < mg_num; i++ {
+		mg := NewMG(i+1, pe_num, pe_weight)
+		device.AddMg(mg)
+	}
+	return device
+}
+
+func (self *Device) GetId(index uint32) uint32 {
+	return self.Mgs[index].Id
+}
+
+func (self *Device) GetWeight(index uint32) uint32 {
+	return self.Mgs[index].Weight
+}
+
+// Size returns the number of MGs.
+func (self *Device) Size() uint32 {
+	return uint32(len(self.Mgs))
+}
+
+// GetMgIndex returns the position of MG mg_id in Mgs.
+func (self *Device) GetMgIndex(mg_id uint32) (uint32, error) {
+	for i, v := range self.Mgs {
+		if mg_id == v.Id {
+			return uint32(i), nil
+		}
+	}
+	return 0, fmt.Errorf("mg %d: %w", mg_id, ErrMgNotFound)
+}
+
+func (self *Device) ClearData(data uint32) {
+	for _, v := range self.Mgs {
+		v.ClearData()
+	}
+	self.Total = 0
+}
+
+// Select returns the MG and the PE key is placed on.
+func (self *Device) Select(key uint32) (mg_id, pe_id uint32, err error) {
+	if self.MgBucket.Weight == 0 {
+		return 0, 0, ErrNoMg
+	}
+	mg_id = self.MgBucket.Select(key)
+	mg_index, err := self.GetMgIndex(mg_id)
+	if err != nil {
+		return 0, 0, err
+	}
+	pe_id, err = self.Mgs[mg_index].Select(key)
+	return mg_id, pe_id, err
+}
+
+// ClearMigrate resets the migrate counters of every MG and PE.
+func (self *Device) ClearMigrate() {
+	for _, v := range self.Mgs {
+		v.ClearMigrate()
+	}
+}
+
+// AddMg adds mg and its bucket item without moving any key.
+func (self *Device) AddMg(mg *MG) error {
+	if self.FindMgById(mg.Id) {
+		return fmt.Errorf("mg %d: %w", mg.Id, ErrMgExists)
+	}
+	self.Weight += mg.Weight
+	self.Total += mg.Total
+	self.Mgs = append(self.Mgs, mg)
+	self.MgBucket.AddItem(mg.Id, mg.Weight)
+	return nil
+}
+
+// DelMg removes the MG at mg_index. The caller removes its bucket item.
+func (self *Device) DelMg(mg_index uint32) {
+	mg := self.Mgs[mg_index]
+	self.Weight -= mg.Weight
+	self.Total -= mg.Total
+	self.Mgs = append(self.Mgs[:mg_index], self.Mgs[mg_index+1:]...)
+	//self.MgBucket.DelItem(mg_index, mg.Weight)
+	//fmt.Println("self.MgBucket =", self.MgBucket)
+}
+
+// AddData places key data on the PE at pe_index of the MG at mg_index.
+func (self *Device) AddData(mg_index, pe_index, data uint32) error {
+	if err := self.Mgs[mg_index].AddData(pe_index, data); err != nil {
+		return err
+	}
+	self.Total++
+	return nil
+}
+
+// AddDataById places key data on PE pe_id of MG mg_id.
+func (self *Device) AddDataById(mg_id, pe_id, data uint32) error {
+	mg_index, err := self.GetMgIndex(mg_id)
+	if err != nil {
+		return err
+	}
+	pe_index, err := self.Mgs[mg_index].GetPeIndex(pe_id)
+	if err != nil {
+		return err
+	}
+	return self.AddData(mg_index, pe_index, data)
+}
+
+// Clone returns a deep copy without the migrate matrix and the moves.
+func (self *Device) Clone() *Device {
+	device := &Device{Id: self.Id, Weight: self.Weight, Total: self.Total}
+	device.Mgs = make([]*MG, 0)
+	for _, v := range self.Mgs {
+		device.Mgs = append(device.Mgs, v.Clone())
+	}
+	self.MgBucket.Clone(&device.MgBucket)
+	return device
+}
+
+func (self *Device) SetMgStandard(mg_index, standard uint32) {
+	self.Mgs[mg_index].Standard = standard
+}
+
+// SetMgWeight changes the weight of the MG at mg_index and of its bucket
+// item. Keys are not moved.
+func (self *Device) SetMgWeight(mg_index, weight uint32) {
+	old_weight := self.Mgs[mg_index].Weight
+	if weight >= old_weight {
+		self.Weight += weight - old_weight
+	} else {
+		self.Weight -= old_weight - weight
+	}
+
+	self.Mgs[mg_index].Weight = weight
+	self.MgBucket.SetWeight(mg_index, weight)
+}
+
+func (self *Device) SetPeStandard(mg_index, pe_index, standard uint32) {
+	self.Mgs[mg_index].Pes[pe_index].Standard = standard
+}
+
+// SetPeWeight changes the weight of a PE, of its MG and of their bucket
+// items. Keys are not moved.
+func (self *Device) SetPeWeight(mg_index, pe_index, weight uint32) {
+	mg := self.Mgs[mg_index]
+	self.Weight -= mg.Weight
+	mg.SetPeWeight(pe_index, weight)
+	self.Weight += mg.Weight
+	self.MgBucket.SetWeight(mg_index, mg.Weight)
+}
+
+func (self *Device) String() string {
+	str := fmt.Sprintf("Device[%d]: weight = %d, total = %d\n", self.Id, self.Weight, self.Total)
+	for _, mg := range self.Mgs {
+		str += mg.String()
+	}
+	return str
+}
+
+func (self *Device) StatDistribution() string {
+	str := fmt.Sprintf("Device[%d]: weight = %d, total = %d\n", self.Id, self.Weight, self.Total)
+	for _, mg := range self.Mgs {
+		str += mg.String()
+	}
+	return str
+}
+
+// CalcStat updates Stat of the device and of every MG.
+func (self *Device) CalcStat() {
+	counts := make([]uint32, 0, len(self.Mgs))
+	weights := make([]uint32, 0, len(self.Mgs))
+	for _, mg := range self.Mgs {
+		mg.CalcStat()
+		counts = append(counts, mg.Total)
+		weights = append(weights, mg.Weight)
+	}
+	self.Stat = CalcDistributeStat(counts, weights)
+}
+
+// PeMaxBiasPercent returns the largest PE bias of all MGs, as computed by
+// the last CalcStat.
+func (self *Device) PeMaxBiasPercent() float64 {
+	max := float64(0)
+	for _, mg := range self.Mgs {
+		if mg.Stat.MaxBiasPercent > max {
+			max = mg.Stat.MaxBiasPercent
+		}
+	}
+	return max
+}
+
+// MigrateTotal sums the accumulated migrate in counters of the PEs and of
+// the MGs.
+func (self *Device) MigrateTotal() (total, cross_mg uint32) {
+	for _, mg := range self.Mgs {
+		cross_mg += mg.Migrate.MigrateIn
+		for _, pe := range mg.Pes {
+			total += pe.Migrate.MigrateIn
+		}
+	}
+	return total, cross_mg
+}
+
+func (self *Device) SetStandard(total uint32) {
+	mg_standard := total / self.Size()
+	for _, mg := range self.Mgs {
+		mg.SetStandard(mg_standard)
+	}
+}
+
+// Migrate moves key data between PEs, counts the move and records it in
+// Moves.
+func (self *Device) Migrate(from_mg_id, from_pe_id, to_mg_id, to_pe_id, data uint32) error {
+	from_mg_index, err := self.GetMgIndex(from_mg_id)
+	if err != nil {
+		return err
+	}
+	to_mg_index, err := self.GetMgIndex(to_mg_id)
+	if err != nil {
+		return err
+	}
+	from_pe_index, err := self.Mgs[from_mg_index].GetPeIndex(from_pe_id)
+	if err != nil {
+		return err
+	}
+	to_pe_index, err := self.Mgs[to_mg_index].GetPeIndex(to_pe_id)
+	if err != nil {
+		return err
+	}
+	if _, ok := self.Mgs[to_mg_index].Pes[to_pe_index].Data[data]; ok {
+		return fmt.Errorf("migrate to mg %d pe %d key %d: %w", to_mg_id, to_pe_id, data, ErrKeyDuplicate)
+	}
+
+	if from_mg_id != to_mg_id {
+		if err := self.Mgs[from_mg_index].MigrateOutData(from_pe_index, data); err != nil {
+			return err
+		}
+		self.Mgs[to_mg_index].MigrateInData(to_pe_index, data)
+	} else {
+		if err := self.Mgs[from_mg_index].PeMigrateOutData(from_pe_index, data); err != nil {
+			return err
+		}
+		self.Mgs[to_mg_index].PeMigrateInData(to_pe_index, data)
+	}
+
+	if self.MigrateMatrix == nil {
+		self.MigrateMatrix = make(map[MigrateKey]uint32)
+	}
+	self.MigrateMatrix[MigrateKey{FromMgId: from_mg_id, ToMgId: to_mg_id}]++
+	self.Moves = append(self.Moves, Move{Key: data, FromMgId: from_mg_id, FromPeId: from_pe_id, ToMgId: to_mg_id, ToPeId: to_pe_id})
+	return nil
+}
+
+// FindMgById reports whether the device has MG mg_id.
+func (self *Device) FindMgById(mg_id uint32) bool {
+	for _, v := range self.Mgs {
+		if v.Id == mg_id {
+			return true
+		}
+	}
+	return false
+}
+
+// ScaleOutMg adds MG mg_id with pe_num PEs of pe_weight and moves the keys
+// that now belong to it.
+func (self *Device) ScaleOutMg(mg_id, pe_num, pe_weight uint32) (*Device, error) {
+	if self.FindMgById(mg_id) {
+		return nil, fmt.Errorf("scale out mg %d: %w", mg_id, ErrMgExists)
+	}
+
+	device := self.Clone()
+	mg := NewMG(mg_id, pe_num, pe_weight)
+	device.AddMg(mg)
+
+	for _, v := range device.Mgs {
+		if v.Id != mg_id {
+			if err := v.scaleOutMg(device); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return device, nil
+}
+
+// ScaleInMg removes MG mg_id and moves its keys to the other MGs.
+func (self *Device) ScaleInMg(mg_id uint32) (*Device, error) {
+	if !self.FindMgById(mg_id) {
+		return nil, fmt.Errorf("scale in mg %d: %w", mg_id, ErrMgNotFound)
+	}
+
+	device := self.Clone()
+
+	mg_index, _ := device.GetMgIndex(mg_id)
+	device.MgBucket.DelItem(mg_index)
+	if device.MgBucket.Weight == 0 {
+		return nil, fmt.Errorf("scale in mg %d: %w", mg_id, ErrNoMg)
+	}
+
+	if err := device.Mgs[mg_index].scaleInMg(device); err != nil {
+		return nil, err
+	}
+	device.DelMg(mg_index)
+
+	return device, nil
+}
+
+// ScaleUpMg adds PE pe_id of pe_weight to MG mg_id. The MG gains the
+// weight of the PE, so keys move to the new PE from the other PEs of the
+// MG and from the other MGs.
+func (self *Device) ScaleUpMg(mg_id, pe_id, pe_weight uint32) (*Device, error) {
+	if !self.FindMgById(mg_id) {
+		return nil, fmt.Errorf("scale up mg %d: %w", mg_id, ErrMgNotFound)
+	}
+
+	device := self.Clone()
+
+	mg_index, _ := device.GetMgIndex(mg_id)
+	mg := device.Mgs[mg_index]
+	if err := mg.AddPe(pe_id, 0); err != nil {
+		return nil, err
+	}
+	old_weight := mg.Weight
+	device.SetPeWeight(mg_index, mg.Size()-1, pe_weight)
+
+	if err := device.rebalanceMg(mg_index, old_weight); err != nil {
+		return nil, err
+	}
+
+	return device, nil
+}
+
+// ScaleDownMg removes PE pe_id from MG mg_id. The MG loses the weight of
+// the PE, so its keys move to the other PEs of the MG and to the other MGs.
+func (self *Device) ScaleDownMg(mg_id, pe_id uint32) (*Device, error) {
+	if !self.FindMgById(mg_id) {
+		return nil, fmt.Errorf("scale down mg %d: %w", mg_id, ErrMgNotFound)
+	}
+
+	device := self.Clone()
+
+	mg_index, _ := device.GetMgIndex(mg_id)
+	mg := device.Mgs[mg_index]
+	pe_index, err := mg.GetPeIndex(pe_id)
+	if err != nil {
+		return nil, err
+	}
+	old_weight := mg.Weight
+	device.SetPeWeight(mg_index, pe_index, 0)
+
+	if err := device.rebalanceMg(mg_index, old_weight); err != nil {
+		return nil, err
+	}
+
+	mg.PeBucket.DelItem(pe_index)
+	mg.DelPe(pe_index)
+
+	return device, nil
+}
+
+// ReweightPe changes the weight of PE pe_id of MG mg_id, and with it the
+// weight of the MG, and moves the keys that now belong elsewhere.
+func (self *Device) ReweightPe(mg_id, pe_id, weight uint32) (*Device, error) {
+	mg_index, err := self.GetMgIndex(mg_id)
+	if err != nil {
+		return nil, fmt.Errorf("reweight: %w", err)
+	}
+	pe_index, err := self.Mgs[mg_index].GetPeIndex(pe_id)
+	if err != nil {
+		return nil, fmt.Errorf("reweight: %w", err)
+	}
+
+	device := self.Clone()
+	old_weight := device.Mgs[mg_index].Weight
+	device.SetPeWeight(mg_index, pe_index, weight)
+
+	if err := device.rebalanceMg(mg_index, old_weight); err != nil {
+		return nil, err
+	}
+
+	return device, nil
+}
+
+// rebalanceMg moves the keys whose place can change after the weight of the
+// MG at mg_index changed from old_weight. The keys of the MG are selected
+// again, within it if it grew. A key of another MG can only leave for this
+// one, and only if it grew, so just the draws of the two MGs are compared.
+func (self *Device) rebalanceMg(mg_index, old_weight uint32) error {
+	mg := self.Mgs[mg_index]
+	grew := mg.Weight > old_weight
+	for _, pe := range mg.Pes {
+		for key, _ := range pe.Data {
+			to_mg_id, to_pe_id := mg.Id, uint32(0)
+			var err error
+			if grew {
+				to_pe_id, err = mg.Select(key)
+			} else {
+				to_mg_id, to_pe_id, err = self.Select(key)
+			}
+			if err != nil {
+				return err
+			}
+			if to_mg_id != mg.Id || to_pe_id != pe.Id {
+				if err := self.Migrate(mg.Id, pe.Id, to_mg_id, to_pe_id, key); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if !grew {
+		return nil
+	}
+
+	for i, other := range self.Mgs {
+		if uint32(i) == mg_index {
+			continue
+		}
+		for _, pe := range other.Pes {
+			for key, _ := range pe.Data {
+				if !self.MgBucket.beats(int(mg_index), i, key) {
+					continue
+				}
+				to_pe_id, err := mg.Select(key)
+				if err != nil {
+					return err
+				}
+				if err := self.Migrate(other.Id, pe.Id, mg.Id, to_pe_id, key); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// NewRands returns num distinct random keys, mapped to themselves.
+func NewRands(num uint32) map[uint32]uint32 {
+	rands := make(map[uint32]uint32)
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for uint32(len(rands)) < num {
+		x := r.Uint32()
+		//fmt.Println("x =", x)
+		if _, ok := rands[x]; ok {
+			continue
+		}
+		rands[x] = x
+	}
+	return rands
+}
@@ -0,0 +1,80 @@
+package straw2
+
+import (
+	"math"
+
+	"straw2/hash"
+)
+
+// Draw is the straw2 draw of one bucket item for a key. Items of weight 0
+// draw -math.MaxFloat64 and never win.
+type Draw struct {
+	Id     uint32
+	Weight uint32
+	Hash   uint32
+	Draw   float64
+}
+
+func straw2Draw(h, weight uint32) float64 {
+	if weight == 0 {
+		return -math.MaxFloat64
+	}
+	return math.Log(float64(h)/4294967296.0) / float64(weight)
+}
+
+// TraceSelect returns the draws Select compares for key x and the id it
+// returns.
+func (bucket *Bucket) TraceSelect(x uint32) ([]Draw, uint32) {
+	draws := make([]Draw, 0, len(bucket.Items))
+	for _, item := range bucket.Items {
+		h := hash.Rjenkins2(x, item.Id)
+		draws = append(draws, Draw{Id: item.Id, Weight: item.Weight, Hash: h, Draw: straw2Draw(h, item.Weight)})
+	}
+	return draws, bucket.Select(x)
+}
+
+// TraceSelect2 returns the draws Select2 compares for key x in MG mg_id and
+// the id it returns.
+func (bucket *Bucket) TraceSelect2(mg_id, x uint32) ([]Draw, uint32) {
+	draws := make([]Draw, 0, len(bucket.Items))
+	for _, item := range bucket.Items {
+		h := hash.Rjenkins3(x, mg_id, item.Id)
+		draws = append(draws, Draw{Id: item.Id, Weight: item.Weight, Hash: h, Draw: straw2Draw(h, item.Weight)})
+	}
+	return draws, bucket.Select2(mg_id, x)
+}
+
+// Trace explains the placement of one key: the draws of both levels, the
+// MG and PE they select and whether the key is stored there.
+type Trace struct {
+	Key     uint32
+	MgDraws []Draw
+	MgId    uint32
+	PeDraws []Draw
+	PeId    uint32
+	Stored  bool
+}
+
+// Trace follows Select for key and returns every draw it compares.
+func (self *Device) Trace(key uint32) (*Trace, error) {
+	if self.MgBucket.Weight == 0 {
+		return nil, ErrNoMg
+	}
+
+	trace := &Trace{Key: key}
+	trace.MgDraws, trace.MgId = self.MgBucket.TraceSelect(key)
+	mg_index, err := self.GetMgIndex(trace.MgId)
+	if err != nil {
+		return nil, err
+	}
+
+	mg := self.Mgs[mg_index]
+	if mg.PeBucket.Weight == 0 {
+		return nil, ErrNoPe
+	}
+	trace.PeDraws, trace.PeId = mg.PeBucket.TraceSelect2(mg.Id, key)
+	if pe_index, err := mg.GetPeIndex(trace.PeId); err == nil {
+		_, trace.Stored = mg.Pes[pe_index].Data[key]
+	}
+	return trace, nil
+}
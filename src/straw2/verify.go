@@ -0,0 +1,116 @@
+package straw2
+
+import "fmt"
+
+// Verify checks the invariants of the device and returns a problem for
+// every one that does not hold, each wrapping ErrInconsistent:
+//
+//   - the weights of the device, of every MG and of their buckets are the
+//     sums of the weights below them
+//   - the bucket items are the MGs and PEs, in the same order and with the
+//     same weights
+//   - the totals of the device and of every MG are the key counts below them
+//   - every key is stored once, on the PE Select returns for it
+func (self *Device) Verify() []error {
+	problems := make([]error, 0)
+	fail := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Errorf(format+": %w", append(a, ErrInconsistent)...))
+	}
+
+	problems = append(problems, self.MgBucket.verify("device mg bucket")...)
+	if len(self.MgBucket.Items) != len(self.Mgs) {
+		fail("device has %d mgs but %d mg bucket items", len(self.Mgs), len(self.MgBucket.Items))
+	}
+
+	weight := uint32(0)
+	total := uint32(0)
+	keys := make(map[uint32]bool, self.Total)
+	for i, mg := range self.Mgs {
+		weight += mg.Weight
+		total += mg.Total
+		if i < len(self.MgBucket.Items) {
+			item := self.MgBucket.Items[i]
+			if item.Id != mg.Id || item.Weight != mg.Weight {
+				fail("mg %d weight %d, mg bucket item %d is mg %d weight %d", mg.Id, mg.Weight, i, item.Id, item.Weight)
+			}
+		}
+		problems = append(problems, mg.verify(self, keys)...)
+	}
+
+	if weight != self.Weight {
+		fail("device weight %d, sum of mg weights %d", self.Weight, weight)
+	}
+	if total != self.Total {
+		fail("device total %d, sum of mg totals %d", self.Total, total)
+	}
+	return problems
+}
+
+func (self *Bucket) verify(name string) []error {
+	weight := uint32(0)
+	for _, v := range self.Items {
+		weight += v.Weight
+	}
+	if weight != self.Weight {
+		return []error{fmt.Errorf("%s weight %d, sum of item weights %d: %w", name, self.Weight, weight, ErrInconsistent)}
+	}
+	return nil
+}
+
+func (self *MG) verify(device *Device, keys map[uint32]bool) []error {
+	problems := make([]error, 0)
+	fail := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Errorf(format+": %w", append(a, ErrInconsistent)...))
+	}
+
+	problems = append(problems, self.PeBucket.verify(fmt.Sprintf("mg %d pe bucket", self.Id))...)
+	if len(self.PeBucket.Items) != len(self.Pes) {
+		fail("mg %d has %d pes but %d pe bucket items", self.Id, len(self.Pes), len(self.PeBucket.Items))
+	}
+
+	weight := uint32(0)
+	total := uint32(0)
+	for i, pe := range self.Pes {
+		weight += pe.Weight
+		total += uint32(len(pe.Data))
+		if i < len(self.PeBucket.Items) {
+			item := self.PeBucket.Items[i]
+			if item.Id != pe.Id || item.Weight != pe.Weight {
+				fail("mg %d pe %d weight %d, pe bucket item %d is pe %d weight %d", self.Id, pe.Id, pe.Weight, i, item.Id, item.Weight)
+			}
+		}
+
+		misplaced := 0
+		example := ""
+		for key, _ := range pe.Data {
+			if keys[key] {
+				fail("mg %d pe %d key %d is stored twice", self.Id, pe.Id, key)
+			}
+			keys[key] = true
+
+			mg_id, pe_id, err := device.Select(key)
+			if err == nil && mg_id == self.Id && pe_id == pe.Id {
+				continue
+			}
+			misplaced++
+			if len(example) == 0 {
+				if err != nil {
+					example = fmt.Sprintf("key %d: %v", key, err)
+				} else {
+					example = fmt.Sprintf("key %d belongs on mg %d pe %d", key, mg_id, pe_id)
+				}
+			}
+		}
+		if misplaced > 0 {
+			fail("mg %d pe %d has %d misplaced keys, %s", self.Id, pe.Id, misplaced, example)
+		}
+	}
+
+	if weight != self.Weight {
+		fail("mg %d weight %d, sum of pe weights %d", self.Id, self.Weight, weight)
+	}
+	if total != self.Total {
+		fail("mg %d total %d, sum of pe key counts %d", self.Id, self.Total, total)
+	}
+	return problems
+}